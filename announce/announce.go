@@ -1,8 +1,6 @@
 package announce
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -10,35 +8,43 @@ import (
 	"time"
 
 	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+	"golang.org/x/net/context"
 )
 
 const (
 	// Defaults for Announce.
-	DefaultEndpoint = "http://127.0.0.1:63412"
+	DefaultEndpoint = client.DefaultEndpoint
 )
 
 type (
 	OptionFunc func(*Announce) error
 
 	Announce struct {
-		app      string
-		endpoint string
-		client   *http.Client
+		app       string
+		endpoints []string
+		http      *http.Client
+		client    *client.Client
 	}
 )
 
 // Endpoint sets the API endpoint.
 func Endpoint(endpoint string) OptionFunc {
+	return Endpoints([]string{endpoint})
+}
+
+// Endpoints sets the API endpoints. They are tried in order when one fails.
+func Endpoints(endpoints []string) OptionFunc {
 	return func(a *Announce) error {
-		a.endpoint = endpoint
+		a.endpoints = endpoints
 		return nil
 	}
 }
 
 // HTTPClient sets the http client to use
-func HTTPClient(client *http.Client) OptionFunc {
+func HTTPClient(c *http.Client) OptionFunc {
 	return func(a *Announce) error {
-		a.client = client
+		a.http = c
 		return nil
 	}
 }
@@ -46,9 +52,9 @@ func HTTPClient(client *http.Client) OptionFunc {
 // New creates a new Announce.
 func New(app string, options ...OptionFunc) (*Announce, error) {
 	a := &Announce{
-		app:      app,
-		endpoint: DefaultEndpoint,
-		client: &http.Client{
+		app:       app,
+		endpoints: []string{DefaultEndpoint},
+		http: &http.Client{
 			Timeout: time.Duration(5 * time.Second),
 		},
 	}
@@ -60,35 +66,20 @@ func New(app string, options ...OptionFunc) (*Announce, error) {
 		}
 	}
 
+	var err error
+	a.client, err = client.New(
+		client.Endpoints(a.endpoints),
+		client.HTTPClient(a.http),
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	return a, nil
 }
 
 // Announce registers a single instance. Set TTL to disable
 func (a *Announce) Announce(i *api.Instance, ttl time.Duration) error {
-	data, err := json.Marshal(i)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("PUT", a.endpoint+"/v0/node/instances/"+a.app, bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := a.client.Do(req)
-
-	if err != nil {
-		return err
-	}
-
-	// currently we do not care about body, though it may have a useful error in it
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
-	}
-
-	return nil
+	_, err := a.client.PutNodeInstance(context.Background(), a.app, i)
+	return err
 }
@@ -1,6 +1,9 @@
 package api
 
-import "net"
+import (
+	"net"
+	"strconv"
+)
 
 type (
 	// Service is a group of instances.
@@ -9,6 +12,14 @@ type (
 		Labels    map[string]string `json:"labels"`
 		Query     map[string]string `json:"query"`
 		Instances []*Instance       `json:"instances,omitempty"`
+		// PanicThreshold is the fraction (0-1) of instances that must be up.
+		// Below it, all instances are returned rather than just those that
+		// are up.
+		PanicThreshold float64 `json:"panic_threshold,omitempty"`
+		Degraded       bool    `json:"degraded,omitempty"` // below the panic threshold
+		// Failover is a list of other onedari API endpoints, such as other
+		// datacenters, tried in order when no instances are up locally.
+		Failover []string `json:"failover,omitempty"`
 	}
 
 	// Instance is a single running instance of an app.
@@ -19,7 +30,8 @@ type (
 		Address  net.IP            `json:"ip"`
 		Port     uint16            `json:"port"`
 		Up       bool              `json:"up"`
-		Metadata map[string]string `json:"metadata"` // arbitrary metadata.
+		Metadata map[string]string `json:"metadata"`         // arbitrary metadata.
+		Remote   string            `json:"remote,omitempty"` // API endpoint of a failover instance
 	}
 
 	// Node is a "server."
@@ -27,8 +39,44 @@ type (
 		ID      string `json:"id"`
 		Address net.IP `json:"ip"` // base ip usually
 	}
+
+	// Index is the current index of the registry. It increases with every change.
+	Index struct {
+		Index uint64 `json:"index"`
+	}
+
+	// Error is the body of an error response from the v1 API.
+	Error struct {
+		Status  int    `json:"status"`  // HTTP status code
+		Code    string `json:"code"`    // such as not_found or invalid
+		Message string `json:"message"` // human readable
+		Field   string `json:"field,omitempty"`
+	}
+
+	// List is a list response from the v1 API.
+	List struct {
+		Items interface{} `json:"items"`
+		// Index is the registry index the list was read at. Pass it to
+		// watch for changes after the list.
+		Index uint64 `json:"index"`
+		// Continue is passed to get the next page. It is empty on the last
+		// page.
+		Continue string `json:"continue,omitempty"`
+	}
+
+	// Event is a single change to the registry.
+	Event struct {
+		Index  uint64 `json:"index"`  // pass as index to watch for the next change
+		Action string `json:"action"` // set, delete, expire, etc
+		Type   string `json:"type"`   // nodes, instances, or services
+		ID     string `json:"id"`
+	}
 )
 
+// DefaultMetadataInt is the value of integer metadata, such as weight and
+// priority, when it is missing or invalid.
+const DefaultMetadataInt = 100
+
 // NewInstance creates a new, blank instance.
 func NewInstance() *Instance {
 	return &Instance{
@@ -36,3 +84,37 @@ func NewInstance() *Instance {
 		Metadata: make(map[string]string),
 	}
 }
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return e.Field + ": " + e.Message
+	}
+	return e.Message
+}
+
+// MetadataInt returns the metadata field f as an integer, such as weight
+// or priority. It is limited to 16 bits, as in DNS SRV records.
+func (i *Instance) MetadataInt(f string) uint16 {
+	v, ok := i.Metadata[f]
+	if !ok {
+		return DefaultMetadataInt
+	}
+
+	if n, err := strconv.ParseUint(v, 10, 16); err == nil {
+		return uint16(n)
+	}
+
+	return DefaultMetadataInt
+}
+
+// LabelMatches returns true if all the labels in query match labels. An
+// empty query matches everything.
+func LabelMatches(labels, query map[string]string) bool {
+	for k, v := range query {
+		val, ok := labels[k]
+		if !ok || v != val {
+			return false
+		}
+	}
+	return true
+}
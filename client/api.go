@@ -0,0 +1,170 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bakins/onedari/api"
+	"golang.org/x/net/context"
+)
+
+// ResyncAction is the action of the event passed to a WatchFunc when
+// changes may have been missed. Anything read from the API should be read
+// again.
+const ResyncAction = "resync"
+
+// WatchFunc is called for each change to the registry. Returning an error
+// stops the watch.
+type WatchFunc func(*api.Event) error
+
+// LocalNode gets the node of the API server.
+func (c *Client) LocalNode(ctx context.Context) (*api.Node, error) {
+	n := &api.Node{}
+	_, err := c.Do(ctx, "GET", "/v0/node", nil, n)
+	return n, err
+}
+
+// Nodes lists all nodes.
+func (c *Client) Nodes(ctx context.Context) ([]*api.Node, error) {
+	nodes := []*api.Node{}
+	_, err := c.Do(ctx, "GET", "/v0/nodes", nil, &nodes)
+	return nodes, err
+}
+
+// Node gets a single node.
+func (c *Client) Node(ctx context.Context, id string) (*api.Node, error) {
+	n := &api.Node{}
+	_, err := c.Do(ctx, "GET", "/v0/nodes/"+url.PathEscape(id), nil, n)
+	return n, err
+}
+
+// NodesByAddress lists the nodes that have the address, either directly
+// or via one of their instances.
+func (c *Client) NodesByAddress(ctx context.Context, ip net.IP) ([]*api.Node, error) {
+	nodes := []*api.Node{}
+	_, err := c.Do(ctx, "GET", "/v0/addresses/"+ip.String(), nil, &nodes)
+	return nodes, err
+}
+
+// Instances lists all instances matching the labels.
+func (c *Client) Instances(ctx context.Context, labels map[string]string) ([]*api.Instance, error) {
+	instances := []*api.Instance{}
+	_, err := c.Do(ctx, "GET", withQuery("/v0/instances", labels), nil, &instances)
+	return instances, err
+}
+
+// NodeInstances lists the instances on the API server's node matching the
+// labels.
+func (c *Client) NodeInstances(ctx context.Context, labels map[string]string) ([]*api.Instance, error) {
+	instances := []*api.Instance{}
+	_, err := c.Do(ctx, "GET", withQuery("/v0/node/instances", labels), nil, &instances)
+	return instances, err
+}
+
+// Instance gets a single instance.
+func (c *Client) Instance(ctx context.Context, id string) (*api.Instance, error) {
+	i := api.NewInstance()
+	_, err := c.Do(ctx, "GET", "/v0/instances/"+url.PathEscape(id), nil, i)
+	return i, err
+}
+
+// PutInstance creates or replaces an instance. It returns the instance as
+// saved.
+func (c *Client) PutInstance(ctx context.Context, i *api.Instance) (*api.Instance, error) {
+	out := api.NewInstance()
+	_, err := c.Do(ctx, "PUT", "/v0/instances/"+url.PathEscape(i.ID), i, out)
+	return out, err
+}
+
+// DeleteInstance removes an instance.
+func (c *Client) DeleteInstance(ctx context.Context, id string) error {
+	_, err := c.Do(ctx, "DELETE", "/v0/instances/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+// PutNodeInstance creates or replaces an instance of app on the API
+// server's node. It returns the instance as saved.
+func (c *Client) PutNodeInstance(ctx context.Context, app string, i *api.Instance) (*api.Instance, error) {
+	out := api.NewInstance()
+	_, err := c.Do(ctx, "PUT", "/v0/node/instances/"+url.PathEscape(app), i, out)
+	return out, err
+}
+
+// Services lists all services with labels matching the labels. The
+// instances are not included.
+func (c *Client) Services(ctx context.Context, labels map[string]string) ([]*api.Service, error) {
+	services := []*api.Service{}
+	_, err := c.Do(ctx, "GET", withQuery("/v0/services", labels), nil, &services)
+	return services, err
+}
+
+// Service gets a single service and its instances.
+func (c *Client) Service(ctx context.Context, id string) (*api.Service, error) {
+	v := &api.Service{}
+	_, err := c.Do(ctx, "GET", "/v0/services/"+url.PathEscape(id), nil, v)
+	return v, err
+}
+
+// PutService creates or replaces a service.
+func (c *Client) PutService(ctx context.Context, v *api.Service) error {
+	_, err := c.Do(ctx, "PUT", "/v0/services/"+url.PathEscape(v.ID), v, nil)
+	return err
+}
+
+// Index gets the current index of the registry.
+func (c *Client) Index(ctx context.Context) (uint64, error) {
+	index := &api.Index{}
+	_, err := c.Do(ctx, "GET", "/v0/index", nil, index)
+	return index.Index, err
+}
+
+// WatchNext waits for the next change after index. It returns nil if there
+// were no changes before the API server's watch timeout.
+func (c *Client) WatchNext(ctx context.Context, index uint64) (*api.Event, error) {
+	e := &api.Event{}
+	code, err := c.do(ctx, watchTimeout, "GET", "/v0/watch?index="+strconv.FormatUint(index, 10), nil, e)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNoContent {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// Watch calls f for every change to the registry until ctx is done or f
+// returns an error. If changes may have been missed, f is called with a
+// ResyncAction event.
+func (c *Client) Watch(ctx context.Context, f WatchFunc) error {
+	index, err := c.Index(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		e, err := c.WatchNext(ctx, index)
+		switch {
+		case err == nil:
+		case IsGone(err):
+			// too far behind, so start over.
+			if index, err = c.Index(ctx); err != nil {
+				return err
+			}
+			e = &api.Event{Index: index, Action: ResyncAction}
+		default:
+			return err
+		}
+
+		// nothing changed
+		if e == nil {
+			continue
+		}
+
+		if err := f(e); err != nil {
+			return err
+		}
+		index = e.Index
+	}
+}
@@ -0,0 +1,317 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultEndpoint is the default URL for onedari API.
+	DefaultEndpoint = "http://127.0.0.1:63412"
+	// DefaultTimeout is the default timeout for a single request.
+	DefaultTimeout = 5 * time.Second
+	// DefaultRetries is the default number of times to retry all endpoints.
+	DefaultRetries = 2
+	// DefaultBackoff is the default wait before the first retry. It doubles
+	// for each retry.
+	DefaultBackoff = 100 * time.Millisecond
+
+	// watchTimeout must be longer than the API server's watch timeout.
+	watchTimeout = 2 * time.Minute
+)
+
+type (
+	// Client is a client for the onedari API. Requests are tried against
+	// each endpoint in turn, starting with the last that succeeded, and
+	// retried with backoff on connection and server errors. It is safe for
+	// concurrent use.
+	Client struct {
+		sync.Mutex
+		endpoints []string
+		current   int // endpoint that last succeeded
+		http      *http.Client
+		timeout   time.Duration
+		retries   int
+		backoff   time.Duration
+	}
+
+	OptionFunc func(*Client) error
+
+	// Error is an error response from the API.
+	Error struct {
+		Err        string `json:"error"`
+		StatusCode int    `json:"code"`
+		Message    string `json:"message"`
+	}
+)
+
+func (e *Error) Error() string {
+	if e.Err != "" {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Message, e.Err)
+	}
+	return fmt.Sprintf("unexpected status: %d", e.StatusCode)
+}
+
+// IsNotFound returns true if err is a not found response.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsGone returns true if err is a gone response, such as a watch index that
+// is too old.
+func IsGone(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusGone
+}
+
+// Endpoints sets the API endpoints. They are tried in order when one fails.
+func Endpoints(endpoints []string) OptionFunc {
+	return func(c *Client) error {
+		c.endpoints = make([]string, 0, len(endpoints))
+		for _, e := range endpoints {
+			e = strings.TrimRight(strings.TrimSpace(e), "/")
+			if e == "" {
+				continue
+			}
+			c.endpoints = append(c.endpoints, e)
+		}
+		if len(c.endpoints) == 0 {
+			return fmt.Errorf("no endpoints")
+		}
+		return nil
+	}
+}
+
+// HTTPClient sets the http client to use.
+func HTTPClient(h *http.Client) OptionFunc {
+	return func(c *Client) error {
+		c.http = h
+		return nil
+	}
+}
+
+// Timeout sets the timeout for a single request.
+func Timeout(timeout time.Duration) OptionFunc {
+	return func(c *Client) error {
+		c.timeout = timeout
+		return nil
+	}
+}
+
+// Retries sets the number of times to retry all endpoints.
+func Retries(retries int) OptionFunc {
+	return func(c *Client) error {
+		c.retries = retries
+		return nil
+	}
+}
+
+// Backoff sets the wait before the first retry. It doubles for each retry.
+func Backoff(backoff time.Duration) OptionFunc {
+	return func(c *Client) error {
+		c.backoff = backoff
+		return nil
+	}
+}
+
+// New creates a new Client.
+func New(options ...OptionFunc) (*Client, error) {
+	c := &Client{
+		endpoints: []string{DefaultEndpoint},
+		http:      &http.Client{},
+		timeout:   DefaultTimeout,
+		retries:   DefaultRetries,
+		backoff:   DefaultBackoff,
+	}
+
+	for _, option := range options {
+		if err := option(c); err != nil {
+			f := runtime.FuncForPC(reflect.ValueOf(option).Pointer()).Name()
+			return nil, fmt.Errorf("failure in function %s: %s", f, err)
+		}
+	}
+
+	return c, nil
+}
+
+// LabelQuery converts labels to a query string.
+func LabelQuery(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := url.Values{}
+	for _, k := range keys {
+		values.Set(k, labels[k])
+	}
+	return values.Encode()
+}
+
+// ParseLabels parses "key=value,key=value" into labels.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label: %s", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// withQuery appends labels to a path as a query string.
+func withQuery(path string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return path
+	}
+	return path + "?" + LabelQuery(labels)
+}
+
+// endpointOrder returns the endpoints starting with the last that
+// succeeded.
+func (c *Client) endpointOrder() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	order := make([]string, 0, len(c.endpoints))
+	for i := range c.endpoints {
+		order = append(order, c.endpoints[(c.current+i)%len(c.endpoints)])
+	}
+	return order
+}
+
+func (c *Client) succeeded(endpoint string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for i, e := range c.endpoints {
+		if e == endpoint {
+			c.current = i
+			return
+		}
+	}
+}
+
+// Do sends a request to the API, trying each endpoint and retrying with
+// backoff on connection errors and server errors. The response is decoded
+// into out if it is not nil. It returns the status code.
+func (c *Client) Do(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	return c.do(ctx, c.timeout, method, path, in, out)
+}
+
+func (c *Client) do(ctx context.Context, timeout time.Duration, method, path string, in, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var err error
+	backoff := c.backoff
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		for _, endpoint := range c.endpointOrder() {
+			var code int
+			code, err = c.send(ctx, timeout, method, endpoint+path, body, out)
+			if err == nil {
+				c.succeeded(endpoint)
+				return code, nil
+			}
+
+			if !retryable(err) {
+				return code, err
+			}
+
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+		}
+	}
+
+	return 0, err
+}
+
+// retryable returns true for connection errors and server errors.
+func retryable(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+func (c *Client) send(ctx context.Context, timeout time.Duration, method, uri string, body []byte, out interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, uri, r)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		e := &Error{}
+		data, _ := ioutil.ReadAll(resp.Body)
+		// the body may not be json, such as from a proxy
+		_ = json.Unmarshal(data, e)
+		e.StatusCode = resp.StatusCode
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+		return resp.StatusCode, e
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return resp.StatusCode, nil
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
@@ -56,7 +56,7 @@ func runAnnounce(cmd *cobra.Command, args []string) {
 
 	a, err := announce.New(
 		app,
-		announce.Endpoint(viper.GetString("api")),
+		announce.Endpoints(strings.Split(viper.GetString("api"), ",")),
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -69,14 +69,8 @@ func runAnnounce(cmd *cobra.Command, args []string) {
 	i.Metadata["weight"] = fmt.Sprintf("%d", viper.GetInt("weight"))
 	i.Metadata["priority"] = fmt.Sprintf("%d", viper.GetInt("priority"))
 
-	_, args = args[0], args[1:]
-	for _, arg := range args {
-		parts := strings.SplitN(arg, "=", 2)
-		if len(parts) != 2 {
-			log.Warningf("ignoring invalid label: %s", arg)
-			continue
-		}
-		i.Labels[parts[0]] = parts[1]
+	for k, v := range parseLabels(args[1:]) {
+		i.Labels[k] = v
 	}
 
 	check := viper.GetString("check")
@@ -123,7 +117,7 @@ func announceCommand() *cobra.Command {
 		Run:   runAnnounce,
 	}
 
-	cmd.PersistentFlags().StringP("api", "a", announce.DefaultEndpoint, "API endpoint")
+	cmd.PersistentFlags().StringP("api", "a", announce.DefaultEndpoint, "comma seperated list of API endpoints")
 	cmd.PersistentFlags().StringP("check", "c", "", "app/service check")
 	cmd.PersistentFlags().StringP("ip", "", "", "node ip. default is detected.")
 	cmd.PersistentFlags().Uint16P("priority", "p", 100, "priority")
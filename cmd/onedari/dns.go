@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/bakins/onedari/dns"
 	"github.com/spf13/cobra"
@@ -11,19 +15,89 @@ func runDNS(cmd *cobra.Command, args []string) {
 	setLogLevel()
 
 	viper.BindPFlag("api", cmd.PersistentFlags().Lookup("api"))
+	viper.BindPFlag("address", cmd.PersistentFlags().Lookup("address"))
 	viper.BindPFlag("ttl", cmd.PersistentFlags().Lookup("ttl"))
 	viper.BindPFlag("domain", cmd.PersistentFlags().Lookup("domain"))
+	viper.BindPFlag("reverse", cmd.PersistentFlags().Lookup("reverse"))
+	viper.BindPFlag("nameservers", cmd.PersistentFlags().Lookup("nameservers"))
+	viper.BindPFlag("nameserver-address", cmd.PersistentFlags().Lookup("nameserver-address"))
+	viper.BindPFlag("negative-ttl", cmd.PersistentFlags().Lookup("negative-ttl"))
+	viper.BindPFlag("forward", cmd.PersistentFlags().Lookup("forward"))
+	viper.BindPFlag("cache-refresh", cmd.PersistentFlags().Lookup("cache-refresh"))
+	viper.BindPFlag("watch", cmd.PersistentFlags().Lookup("watch"))
+	viper.BindPFlag("ip", cmd.PersistentFlags().Lookup("ip"))
+	viper.BindPFlag("name", cmd.PersistentFlags().Lookup("name"))
+	viper.BindPFlag("locality", cmd.PersistentFlags().Lookup("locality"))
+	viper.BindPFlag("local-only", cmd.PersistentFlags().Lookup("local-only"))
+	viper.BindPFlag("doh-address", cmd.PersistentFlags().Lookup("doh-address"))
+	viper.BindPFlag("doh-cert", cmd.PersistentFlags().Lookup("doh-cert"))
+	viper.BindPFlag("doh-key", cmd.PersistentFlags().Lookup("doh-key"))
+	viper.BindPFlag("transfer-acl", cmd.PersistentFlags().Lookup("transfer-acl"))
+	viper.BindPFlag("notify", cmd.PersistentFlags().Lookup("notify"))
+	viper.BindPFlag("zone", cmd.PersistentFlags().Lookup("zone"))
+	viper.BindPFlag("view", cmd.PersistentFlags().Lookup("view"))
+	viper.BindPFlag("query-log", cmd.PersistentFlags().Lookup("query-log"))
+	viper.BindPFlag("metrics-address", cmd.PersistentFlags().Lookup("metrics-address"))
+	viper.BindPFlag("mdns", cmd.PersistentFlags().Lookup("mdns"))
+	viper.BindPFlag("mdns-interface", cmd.PersistentFlags().Lookup("mdns-interface"))
+	viper.BindPFlag("mdns-browse", cmd.PersistentFlags().Lookup("mdns-browse"))
 
 	if len(args) > 0 {
 		log.Fatal("extra command line arguments")
 	}
 
-	s, err := dns.New(
+	// the node is only required to prefer local instances when asked to.
+	n, err := createNode()
+	if err != nil {
+		if viper.GetString("locality") != "" || viper.GetBool("local-only") {
+			log.Fatal(err)
+		}
+		log.WithError(err).Warn("unable to determine node. instances on this node will not be preferred")
+	}
+
+	options := []dns.OptionFunc{
 		dns.Endpoint(viper.GetString("api")),
+		dns.Address(viper.GetString("address")),
 		dns.TTL(uint32(viper.GetInt("ttl"))),
 		dns.Domain(viper.GetString("domain")),
-	)
+		dns.Reverse(viper.GetBool("reverse")),
+		dns.Nameservers(strings.Split(viper.GetString("nameservers"), ",")),
+		dns.NameserverAddresses(strings.Split(viper.GetString("nameserver-address"), ",")),
+		dns.NegativeTTL(uint32(viper.GetInt("negative-ttl"))),
+		dns.Forwarders(strings.Split(viper.GetString("forward"), ",")),
+		dns.CacheRefresh(viper.GetDuration("cache-refresh")),
+		dns.Watch(viper.GetBool("watch")),
+		dns.Node(n),
+		dns.Locality(parseLabels(strings.Split(viper.GetString("locality"), ","))),
+		dns.LocalOnly(viper.GetBool("local-only")),
+		dns.DoHAddress(viper.GetString("doh-address")),
+		dns.DoHTLS(viper.GetString("doh-cert"), viper.GetString("doh-key")),
+		dns.TransferACL(strings.Split(viper.GetString("transfer-acl"), ",")),
+		dns.Notify(strings.Split(viper.GetString("notify"), ",")),
+		dns.QueryLog(viper.GetBool("query-log")),
+		dns.MetricsAddress(viper.GetString("metrics-address")),
+		dns.MDNS(viper.GetBool("mdns")),
+		dns.MDNSInterface(viper.GetString("mdns-interface")),
+		dns.MDNSBrowse(viper.GetDuration("mdns-browse")),
+	}
+
+	for _, z := range viper.GetStringSlice("zone") {
+		option, err := parseZone(z)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, option)
+	}
+
+	for _, v := range viper.GetStringSlice("view") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid view: %s", v)
+		}
+		options = append(options, dns.View(strings.Split(parts[0], ","), parts[1]))
+	}
 
+	s, err := dns.New(options...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -41,8 +115,54 @@ func dnsCommand() *cobra.Command {
 	}
 
 	cmd.PersistentFlags().StringP("api", "a", dns.DefaultEndpoint, "API endpoint")
+	cmd.PersistentFlags().String("address", dns.DefaultAddress, "UDP and TCP listen address")
 	cmd.PersistentFlags().Uint32P("ttl", "t", dns.DefaultTTL, "DNS ttl")
 	cmd.PersistentFlags().StringP("domain", "d", dns.DefaultDomain, "DNS domain")
+	cmd.PersistentFlags().String("nameservers", "", "comma seperated list of nameservers for NS and SOA records. Default is ns.<domain>")
+	cmd.PersistentFlags().String("nameserver-address", "", "comma seperated list of addresses for nameservers within the domain. Default is the listen address")
+	cmd.PersistentFlags().Uint32("negative-ttl", dns.DefaultNegativeTTL, "how long resolvers may cache negative answers, from the SOA minimum")
+	cmd.PersistentFlags().String("forward", "", "comma seperated list of upstream resolvers for names outside of the domain")
+	cmd.PersistentFlags().Duration("cache-refresh", dns.DefaultCacheRefresh, "how long to cache API responses. 0 disables the cache")
+	cmd.PersistentFlags().Bool("watch", true, "watch the API for changes to invalidate the cache and update the SOA serial")
+	cmd.PersistentFlags().StringP("name", "n", "", "node name. Default is hostname.")
+	cmd.PersistentFlags().StringP("ip", "", "", "node ip. default is detected.")
+	cmd.PersistentFlags().String("locality", "", "comma seperated list of labels, such as zone=east, preferred after instances on this node")
+	cmd.PersistentFlags().Bool("local-only", false, "only answer with the closest instances")
+	cmd.PersistentFlags().String("doh-address", "", "listen address for DNS-over-HTTPS. Disabled by default")
+	cmd.PersistentFlags().String("doh-cert", "", "DNS-over-HTTPS TLS certificate file")
+	cmd.PersistentFlags().String("doh-key", "", "DNS-over-HTTPS TLS key file")
+	cmd.PersistentFlags().String("transfer-acl", "", "comma seperated list of addresses or CIDRs allowed to transfer the zone")
+	cmd.PersistentFlags().String("notify", "", "comma seperated list of secondaries to notify when the registry changes")
+	cmd.PersistentFlags().StringArray("zone", nil, "additional domain as domain=endpoint?label=value. Endpoint defaults to --api. May be repeated")
+	cmd.PersistentFlags().StringArray("view", nil, "answer clients in CIDRs with an instance metadata field as the address, as cidr,cidr=field. May be repeated")
+	cmd.PersistentFlags().Bool("query-log", false, "log every query")
+	cmd.PersistentFlags().String("metrics-address", "", "listen address for Prometheus metrics. Disabled by default")
+	cmd.PersistentFlags().Bool("reverse", false, "answer PTR queries for node and instance addresses")
+	cmd.PersistentFlags().Bool("mdns", false, "advertise services as DNS-SD records over multicast DNS")
+	cmd.PersistentFlags().String("mdns-interface", "", "interface for multicast DNS. Default is the system default")
+	cmd.PersistentFlags().Duration("mdns-browse", 0, "how often to browse multicast DNS for services to import as instances. 0 disables it")
 
 	return cmd
 }
+
+// parseZone parses domain=endpoint?label=value into a zone. The query
+// string is the label filter.
+func parseZone(z string) (dns.OptionFunc, error) {
+	parts := strings.SplitN(z, "=", 2)
+	if len(parts) == 1 {
+		return dns.Zone(parts[0], "", nil), nil
+	}
+
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid zone %s: %s", z, err)
+	}
+
+	query := make(map[string]string)
+	for k, v := range u.Query() {
+		query[k] = v[0]
+	}
+	u.RawQuery = ""
+
+	return dns.Zone(parts[0], u.String(), query), nil
+}
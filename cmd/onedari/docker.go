@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/client"
+	"github.com/bakins/onedari/docker"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func runDockerAnnounce(cmd *cobra.Command, args []string) {
+	setLogLevel()
+
+	flags := cmd.PersistentFlags()
+
+	viper.BindPFlag("api", flags.Lookup("api"))
+	viper.BindPFlag("socket", flags.Lookup("socket"))
+	viper.BindPFlag("interval", flags.Lookup("interval"))
+
+	if len(args) > 0 {
+		log.Fatal("extra command line arguments")
+	}
+
+	c, err := client.New(
+		client.Endpoints(strings.Split(viper.GetString("api"), ",")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a, err := docker.New(
+		docker.Client(c),
+		docker.Socket(viper.GetString("socket")),
+		docker.Interval(viper.GetDuration("interval")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := a.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dockerAnnounceCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "docker-announce",
+		Short: "Announce Docker containers",
+		Run:   runDockerAnnounce,
+	}
+
+	flags := cmd.PersistentFlags()
+	flags.StringP("api", "a", client.DefaultEndpoint, "comma seperated list of API endpoints")
+	flags.String("socket", docker.DefaultSocket, "Docker Engine API socket")
+	flags.Duration("interval", docker.DefaultInterval, "announce interval")
+
+	return cmd
+}
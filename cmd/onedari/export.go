@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+	"github.com/bakins/onedari/dns"
+	d "github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+)
+
+type (
+	// exporter writes instances and their nodes to a file in one of
+	// several formats.
+	exporter struct {
+		client  *client.Client
+		format  string
+		service string
+		labels  map[string]string
+		domain  string
+		output  string
+		last    []byte // last output, when writing to stdout
+	}
+
+	// export is the data for the json format.
+	export struct {
+		Nodes     []*api.Node     `json:"nodes"`
+		Instances []*api.Instance `json:"instances"`
+	}
+)
+
+var exportFormats = map[string]func(*exporter, *export) ([]byte, error){
+	"hosts":    (*exporter).hostsFormat,
+	"json":     (*exporter).jsonFormat,
+	"csv":      (*exporter).csvFormat,
+	"srv-zone": (*exporter).srvZoneFormat,
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	setLogLevel()
+
+	flags := cmd.PersistentFlags()
+
+	viper.BindPFlag("api", flags.Lookup("api"))
+	viper.BindPFlag("format", flags.Lookup("format"))
+	viper.BindPFlag("service", flags.Lookup("service"))
+	viper.BindPFlag("label", flags.Lookup("label"))
+	viper.BindPFlag("domain", flags.Lookup("domain"))
+	viper.BindPFlag("output", flags.Lookup("output"))
+	viper.BindPFlag("watch", flags.Lookup("watch"))
+
+	if len(args) > 0 {
+		log.Fatal("extra command line arguments")
+	}
+
+	c, err := client.New(
+		client.Endpoints(strings.Split(viper.GetString("api"), ",")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	e := &exporter{
+		client:  c,
+		format:  viper.GetString("format"),
+		service: viper.GetString("service"),
+		labels:  parseLabels(viper.GetStringSlice("label")),
+		domain:  d.Fqdn(strings.ToLower(viper.GetString("domain"))),
+		output:  viper.GetString("output"),
+	}
+
+	if _, ok := exportFormats[e.format]; !ok {
+		log.Fatalf("unknown format: %s", e.format)
+	}
+
+	if e.format == "srv-zone" && e.service == "" {
+		log.Fatal("srv-zone format requires a service")
+	}
+
+	if err := e.export(); err != nil {
+		log.Fatal(err)
+	}
+
+	if !viper.GetBool("watch") {
+		return
+	}
+
+	exportAll := func() {
+		if err := e.export(); err != nil {
+			log.Error(err)
+		}
+	}
+
+	for {
+		err := c.Watch(context.Background(), func(*api.Event) error {
+			exportAll()
+			return nil
+		})
+		log.Error(err)
+
+		// we may have missed changes
+		time.Sleep(time.Second)
+		exportAll()
+	}
+}
+
+// export writes the current instances if they changed.
+func (e *exporter) export() error {
+	v, err := e.fetch()
+	if err != nil {
+		return err
+	}
+
+	data, err := exportFormats[e.format](e, v)
+	if err != nil {
+		return err
+	}
+
+	if e.output == "" || e.output == "-" {
+		if e.last != nil && bytes.Equal(e.last, data) {
+			return nil
+		}
+		e.last = data
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	current, err := ioutil.ReadFile(e.output)
+	if err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	if err := writeFileAtomic(e.output, data); err != nil {
+		return err
+	}
+	log.Infof("exported to %s", e.output)
+	return nil
+}
+
+// fetch gets the instances of the service, or the up instances matching
+// the labels, and the nodes they are on.
+func (e *exporter) fetch() (*export, error) {
+	ctx := context.Background()
+	v := &export{}
+
+	if e.service != "" {
+		s, err := e.client.Service(ctx, e.service)
+		if err != nil {
+			return nil, err
+		}
+		v.Instances = s.Instances
+	} else {
+		instances, err := e.client.Instances(ctx, e.labels)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range instances {
+			if i.Up {
+				v.Instances = append(v.Instances, i)
+			}
+		}
+	}
+
+	nodes, err := e.client.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(v.Instances))
+	for _, i := range v.Instances {
+		ids[i.Node] = true
+	}
+	for _, n := range nodes {
+		if ids[n.ID] {
+			v.Nodes = append(v.Nodes, n)
+		}
+	}
+
+	// stable output so unchanged data is not rewritten
+	sort.Slice(v.Instances, func(a, b int) bool { return v.Instances[a].ID < v.Instances[b].ID })
+	sort.Slice(v.Nodes, func(a, b int) bool { return v.Nodes[a].ID < v.Nodes[b].ID })
+
+	if v.Instances == nil {
+		v.Instances = []*api.Instance{}
+	}
+	if v.Nodes == nil {
+		v.Nodes = []*api.Node{}
+	}
+
+	return v, nil
+}
+
+// hostsFormat uses the same names as the DNS server, without the
+// trailing dot.
+func (e *exporter) hostsFormat(v *export) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, n := range v.Nodes {
+		if n.Address == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\t%s %s\n", n.Address, strings.TrimSuffix(e.name(n.ID, "nodes"), "."), strings.ToLower(n.ID))
+	}
+	for _, i := range v.Instances {
+		if i.Address == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", i.Address, strings.TrimSuffix(e.name(i.ID, "instances"), "."))
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *exporter) jsonFormat(v *export) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (e *exporter) csvFormat(v *export) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	_ = w.Write([]string{"id", "node", "ip", "port", "up", "labels", "metadata"})
+	for _, i := range v.Instances {
+		ip := ""
+		if i.Address != nil {
+			ip = i.Address.String()
+		}
+		_ = w.Write([]string{
+			i.ID,
+			i.Node,
+			ip,
+			strconv.Itoa(int(i.Port)),
+			strconv.FormatBool(i.Up),
+			joinLabels(i.Labels),
+			joinLabels(i.Metadata),
+		})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// srvZoneFormat writes SRV records for the service and A/AAAA records for its
+// nodes, as the DNS server would answer them.
+func (e *exporter) srvZoneFormat(v *export) ([]byte, error) {
+	var buf bytes.Buffer
+
+	name := e.name(e.service, "services")
+	for _, i := range v.Instances {
+		if i.Node == "" || i.Port == 0 {
+			continue
+		}
+		rr := &d.SRV{
+			Hdr:      d.RR_Header{Name: name, Rrtype: d.TypeSRV, Class: d.ClassINET},
+			Port:     i.Port,
+			Target:   e.name(i.Node, "nodes"),
+			Weight:   i.MetadataInt("weight"),
+			Priority: i.MetadataInt("priority"),
+		}
+		fmt.Fprintln(&buf, rr.String())
+	}
+
+	for _, n := range v.Nodes {
+		if n.Address == nil {
+			continue
+		}
+		hdr := d.RR_Header{Name: e.name(n.ID, "nodes"), Class: d.ClassINET}
+		var rr d.RR
+		if ip4 := n.Address.To4(); ip4 != nil {
+			hdr.Rrtype = d.TypeA
+			rr = &d.A{Hdr: hdr, A: ip4}
+		} else {
+			hdr.Rrtype = d.TypeAAAA
+			rr = &d.AAAA{Hdr: hdr, AAAA: n.Address}
+		}
+		fmt.Fprintln(&buf, rr.String())
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *exporter) name(id, kind string) string {
+	return strings.ToLower(id) + "." + kind + "." + e.domain
+}
+
+// joinLabels formats labels as sorted key=value pairs separated by ;
+func joinLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+func exportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export instances to a file",
+		Run:   runExport,
+	}
+
+	flags := cmd.PersistentFlags()
+	flags.StringP("api", "a", client.DefaultEndpoint, "comma seperated list of API endpoints")
+	flags.StringP("format", "f", "hosts", "output format: hosts, json, csv, or srv-zone")
+	flags.StringP("service", "s", "", "export instances of this service")
+	flags.StringArray("label", nil, "export up instances with this label as key=value. May be repeated")
+	flags.String("domain", dns.DefaultDomain, "DNS domain for host names")
+	flags.StringP("output", "o", "-", "output file. It is written atomically")
+	flags.BoolP("watch", "w", false, "rewrite the output when the registry changes")
+
+	return cmd
+}
@@ -27,6 +27,11 @@ func main() {
 		serverCommand(),
 		announceCommand(),
 		dnsCommand(),
+		templateCommand(),
+		xdsCommand(),
+		proxyCommand(),
+		exportCommand(),
+		dockerAnnounceCommand(),
 	)
 	_ = root.Execute()
 }
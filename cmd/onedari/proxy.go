@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/client"
+	"github.com/bakins/onedari/proxy"
+	"github.com/bakins/onedari/transport"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func runProxy(cmd *cobra.Command, args []string) {
+	setLogLevel()
+
+	flags := cmd.PersistentFlags()
+
+	viper.BindPFlag("api", flags.Lookup("api"))
+	viper.BindPFlag("listen", flags.Lookup("listen"))
+	viper.BindPFlag("domain", flags.Lookup("domain"))
+	viper.BindPFlag("prefix", flags.Lookup("prefix"))
+	viper.BindPFlag("retries", flags.Lookup("retries"))
+	viper.BindPFlag("outlier", flags.Lookup("outlier"))
+	viper.BindPFlag("ejection", flags.Lookup("ejection"))
+	viper.BindPFlag("max-idle-conns", flags.Lookup("max-idle-conns"))
+
+	if len(args) > 0 {
+		log.Fatal("extra command line arguments")
+	}
+
+	c, err := client.New(
+		client.Endpoints(strings.Split(viper.GetString("api"), ",")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p, err := proxy.New(
+		proxy.Address(viper.GetString("listen")),
+		proxy.Client(c),
+		proxy.Domain(viper.GetString("domain")),
+		proxy.Prefix(viper.GetString("prefix")),
+		proxy.Retries(viper.GetInt("retries")),
+		proxy.Outlier(viper.GetInt("outlier")),
+		proxy.Ejection(viper.GetDuration("ejection")),
+		proxy.MaxIdleConns(viper.GetInt("max-idle-conns")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := p.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func proxyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Run HTTP proxy to services",
+		Run:   runProxy,
+	}
+
+	flags := cmd.PersistentFlags()
+	flags.String("api", client.DefaultEndpoint, "comma seperated list of API endpoints")
+	flags.String("listen", proxy.DefaultAddress, "listen address")
+	flags.String("domain", proxy.DefaultDomain, "DNS domain of service host names")
+	flags.String("prefix", proxy.DefaultPrefix, "path prefix for routing by path. empty to disable")
+	flags.Int("retries", proxy.DefaultRetries, "other instances to try when connecting fails")
+	flags.Int("outlier", proxy.DefaultOutlier, "consecutive 5xx responses before an instance is ejected. 0 to disable")
+	flags.Duration("ejection", transport.DefaultEjection, "how long an ejected instance is skipped")
+	flags.Int("max-idle-conns", proxy.DefaultMaxIdleConns, "idle connections kept per instance")
+
+	return cmd
+}
@@ -17,6 +17,7 @@ func runServer(cmd *cobra.Command, _ []string) {
 	viper.BindPFlag("ip", cmd.PersistentFlags().Lookup("ip"))
 	viper.BindPFlag("name", cmd.PersistentFlags().Lookup("name"))
 	viper.BindPFlag("prefix", cmd.PersistentFlags().Lookup("prefix"))
+	viper.BindPFlag("consul", cmd.PersistentFlags().Lookup("consul"))
 
 	endpoints := make([]string, 2)
 	for _, e := range strings.Split(viper.GetString("etcd"), ",") {
@@ -33,6 +34,7 @@ func runServer(cmd *cobra.Command, _ []string) {
 		server.Address(viper.GetString("address")),
 		server.EtcdEndpoints(endpoints),
 		server.Prefix(viper.GetString("prefix")),
+		server.Consul(viper.GetBool("consul")),
 	)
 
 	if err != nil {
@@ -57,6 +59,7 @@ func serverCommand() *cobra.Command {
 	cmd.PersistentFlags().StringP("prefix", "p", server.DefaultPrefix, "etcd prefix")
 	cmd.PersistentFlags().StringP("name", "n", "", "node name. Default is hostname.")
 	cmd.PersistentFlags().StringP("ip", "", "", "node ip. default is detected.")
+	cmd.PersistentFlags().Bool("consul", false, "serve a subset of the Consul HTTP API under /v1")
 
 	return cmd
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+)
+
+// reloadRetry is how often a failed command is retried.
+const reloadRetry = 10 * time.Second
+
+type (
+	// renderer renders a single template to a file.
+	renderer struct {
+		source  string
+		dest    string
+		command string
+		tmpl    *template.Template
+		// the file changed but the command has not succeeded since.
+		pending bool
+	}
+)
+
+func runTemplate(cmd *cobra.Command, args []string) {
+	setLogLevel()
+
+	flags := cmd.PersistentFlags()
+
+	viper.BindPFlag("api", flags.Lookup("api"))
+	viper.BindPFlag("template", flags.Lookup("template"))
+	viper.BindPFlag("once", flags.Lookup("once"))
+	viper.BindPFlag("wait", flags.Lookup("wait"))
+
+	if len(args) > 0 {
+		log.Fatal("extra command line arguments")
+	}
+
+	c, err := client.New(
+		client.Endpoints(strings.Split(viper.GetString("api"), ",")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	specs := viper.GetStringSlice("template")
+	if len(specs) == 0 {
+		log.Fatal("need at least one template")
+	}
+
+	renderers := make([]*renderer, 0, len(specs))
+	for _, spec := range specs {
+		r, err := newRenderer(spec, templateFuncs(c))
+		if err != nil {
+			log.Fatal(err)
+		}
+		renderers = append(renderers, r)
+	}
+
+	renderAll := func() {
+		for _, r := range renderers {
+			if err := r.render(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	renderAll()
+	if viper.GetBool("once") {
+		return
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			err := c.Watch(context.Background(), func(*api.Event) error {
+				notify(changes)
+				return nil
+			})
+			log.Error(err)
+
+			// we may have missed changes
+			time.Sleep(time.Second)
+			notify(changes)
+		}
+	}()
+
+	wait := viper.GetDuration("wait")
+	for {
+		var retry <-chan time.Time
+		for _, r := range renderers {
+			if r.pending {
+				retry = time.After(reloadRetry)
+				break
+			}
+		}
+
+		select {
+		case <-changes:
+			quiet(changes, wait)
+		case <-retry:
+		}
+		renderAll()
+	}
+}
+
+// notify signals a change without blocking if one is already pending.
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// quiet waits until there have been no changes for wait, so a burst of
+// changes is rendered once. A steady stream of changes is rendered every
+// ten waits.
+func quiet(changes chan struct{}, wait time.Duration) {
+	deadline := time.After(10 * wait)
+	for {
+		select {
+		case <-changes:
+		case <-time.After(wait):
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// newRenderer parses source:dest:command.
+func newRenderer(spec string, funcs template.FuncMap) (*renderer, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid template: %s", spec)
+	}
+
+	r := &renderer{
+		source: parts[0],
+		dest:   parts[1],
+	}
+	if len(parts) == 3 {
+		r.command = parts[2]
+	}
+
+	var err error
+	r.tmpl, err = template.New(filepath.Base(r.source)).Funcs(funcs).ParseFiles(r.source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %s", r.source, err)
+	}
+
+	return r, nil
+}
+
+// render writes the template if the output changed and then runs the
+// command. The command is ran again on every render until it succeeds.
+func (r *renderer) render() error {
+	var buf bytes.Buffer
+	if err := r.tmpl.Execute(&buf, nil); err != nil {
+		return fmt.Errorf("failed to render %s: %s", r.source, err)
+	}
+
+	current, err := ioutil.ReadFile(r.dest)
+	if err != nil || !bytes.Equal(current, buf.Bytes()) {
+		if err := writeFileAtomic(r.dest, buf.Bytes()); err != nil {
+			return err
+		}
+		log.Infof("rendered %s to %s", r.source, r.dest)
+		r.pending = r.command != ""
+	}
+
+	if !r.pending {
+		return nil
+	}
+
+	c := exec.Command("/bin/sh", "-c", r.command)
+	output, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command failed '%s' : %s : '%s'", r.command, err, output)
+	}
+	r.pending = false
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and
+// renames it, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// keep the mode of the existing file
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// templateFuncs are the functions available in templates.
+func templateFuncs(c *client.Client) template.FuncMap {
+	return template.FuncMap{
+		"service": func(id string) (*api.Service, error) {
+			return c.Service(context.Background(), id)
+		},
+		"services": func() ([]*api.Service, error) {
+			return c.Services(context.Background(), nil)
+		},
+		"instances": func(query string) ([]*api.Instance, error) {
+			labels, err := client.ParseLabels(query)
+			if err != nil {
+				return nil, err
+			}
+			return c.Instances(context.Background(), labels)
+		},
+		"nodes": func() ([]*api.Node, error) {
+			return c.Nodes(context.Background())
+		},
+	}
+}
+
+func templateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "template",
+		Short: "Render templates from the registry",
+		Run:   runTemplate,
+	}
+
+	cmd.PersistentFlags().StringP("api", "a", client.DefaultEndpoint, "comma seperated list of API endpoints")
+	cmd.PersistentFlags().StringArrayP("template", "t", nil, "template as source:destination:command. The command is ran when the destination changes. May be repeated")
+	cmd.PersistentFlags().Bool("once", false, "render once and exit")
+	cmd.PersistentFlags().Duration("wait", 2*time.Second, "how long the registry must be quiet after a change before rendering")
+
+	return cmd
+}
@@ -86,3 +86,20 @@ func createNode() (*api.Node, error) {
 	}
 	return n, nil
 }
+
+// parseLabels parses key=value pairs into labels.
+func parseLabels(args []string) map[string]string {
+	labels := make(map[string]string, len(args))
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			log.Warningf("ignoring invalid label: %s", arg)
+			continue
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels
+}
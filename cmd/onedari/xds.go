@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/client"
+	"github.com/bakins/onedari/xds"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func runXDS(cmd *cobra.Command, args []string) {
+	setLogLevel()
+
+	viper.BindPFlag("api", cmd.PersistentFlags().Lookup("api"))
+	viper.BindPFlag("address", cmd.PersistentFlags().Lookup("address"))
+	viper.BindPFlag("connect-timeout", cmd.PersistentFlags().Lookup("connect-timeout"))
+
+	if len(args) > 0 {
+		log.Fatal("extra command line arguments")
+	}
+
+	c, err := client.New(
+		client.Endpoints(strings.Split(viper.GetString("api"), ",")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := xds.New(
+		xds.Address(viper.GetString("address")),
+		xds.Client(c),
+		xds.ConnectTimeout(viper.GetDuration("connect-timeout")),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := s.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func xdsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "xds",
+		Short: "Run Envoy xDS server",
+		Run:   runXDS,
+	}
+
+	cmd.PersistentFlags().String("api", client.DefaultEndpoint, "comma seperated list of API endpoints")
+	cmd.PersistentFlags().String("address", xds.DefaultAddress, "listen address")
+	cmd.PersistentFlags().Duration("connect-timeout", xds.DefaultConnectTimeout, "cluster connect timeout")
+
+	return cmd
+}
@@ -0,0 +1,224 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bakins/onedari/api"
+)
+
+const (
+	// maxAPICacheEntries bounds the API response cache.
+	maxAPICacheEntries = 10000
+	// watchTimeout must be longer than the API server's watch timeout.
+	watchTimeout = 2 * time.Minute
+)
+
+type (
+	// apiCache caches API responses by URI. Entries expire after refresh
+	// or when the registry changes, but are kept so they can be served
+	// stale if the API is unreachable.
+	apiCache struct {
+		// updated atomically, so first to be 64-bit aligned on 32-bit
+		// platforms.
+		stats CacheStats
+
+		sync.Mutex
+		refresh    time.Duration
+		generation uint64
+		entries    map[string]*apiEntry
+	}
+
+	apiEntry struct {
+		data       []byte
+		notFound   bool
+		fetched    time.Time
+		generation uint64
+	}
+
+	// CacheStats are counters for the API response cache.
+	CacheStats struct {
+		Hits   uint64 `json:"hits"`
+		Misses uint64 `json:"misses"`
+		Stale  uint64 `json:"stale"` // served because the API was unreachable
+	}
+)
+
+func newAPICache(refresh time.Duration) *apiCache {
+	return &apiCache{
+		refresh: refresh,
+		entries: make(map[string]*apiEntry),
+	}
+}
+
+// invalidate expires all entries.
+func (c *apiCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+}
+
+// current returns the generation. Fetches record it before they start, so
+// an invalidation during the fetch expires the response.
+func (c *apiCache) current() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+func (c *apiCache) lookup(uri string) (*apiEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[uri]
+	if !ok {
+		return nil, false
+	}
+	fresh := e.generation == c.generation && time.Since(e.fetched) < c.refresh
+	return e, fresh
+}
+
+func (c *apiCache) store(uri string, e *apiEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[uri]; !ok && len(c.entries) >= maxAPICacheEntries {
+		// evict something. map order is random enough.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[uri] = e
+}
+
+func (e *apiEntry) decode(v interface{}) error {
+	if e.notFound {
+		return NotFoundError
+	}
+	return json.Unmarshal(e.data, v)
+}
+
+// CacheStats returns the API response cache counters.
+func (s *Server) CacheStats() CacheStats {
+	if s.apiCache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&s.apiCache.stats.Hits),
+		Misses: atomic.LoadUint64(&s.apiCache.stats.Misses),
+		Stale:  atomic.LoadUint64(&s.apiCache.stats.Stale),
+	}
+}
+
+// get fetches uri from the API into v, using the cache if enabled.
+func (s *Server) get(uri string, v interface{}) error {
+	c := s.apiCache
+	if c == nil {
+		return s.DoHTTP(uri, v)
+	}
+
+	e, fresh := c.lookup(uri)
+	if fresh {
+		atomic.AddUint64(&c.stats.Hits, 1)
+		return e.decode(v)
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+
+	generation := c.current()
+	data, err := s.doHTTP(uri)
+	switch {
+	case err == nil:
+		e = &apiEntry{data: data, fetched: time.Now(), generation: generation}
+	case err == NotFoundError:
+		e = &apiEntry{notFound: true, fetched: time.Now(), generation: generation}
+	case e != nil:
+		// the API is unreachable, so serve what we have.
+		atomic.AddUint64(&c.stats.Stale, 1)
+		return e.decode(v)
+	default:
+		return err
+	}
+
+	c.store(uri, e)
+	return e.decode(v)
+}
+
+// watchAPI invalidates the cache, updates the SOA serial, and notifies
+// secondaries whenever the registry changes. It does not return.
+func (s *Server) watchAPI() {
+	client := &http.Client{
+		Timeout: watchTimeout,
+	}
+
+	var index uint64
+	for {
+		e, err := s.watchNext(client, index)
+		if err != nil {
+			// we may have missed changes, so start over.
+			if s.apiCache != nil {
+				s.apiCache.invalidate()
+			}
+			index = 0
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// nothing changed
+		if e == nil {
+			continue
+		}
+
+		s.changed(e.Index)
+		index = e.Index
+	}
+}
+
+// changed is called when the registry changes.
+func (s *Server) changed(index uint64) {
+	if s.apiCache != nil {
+		s.apiCache.invalidate()
+	}
+	atomic.StoreUint32(&s.serial, uint32(index))
+
+	// don't block if a notify is already pending.
+	select {
+	case s.notifyPending <- struct{}{}:
+	default:
+	}
+
+	if s.mdns != nil {
+		select {
+		case s.mdns.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Server) watchNext(client *http.Client, index uint64) (*api.Event, error) {
+	resp, err := client.Get(s.endpoint + "/v0/watch?index=" + strconv.FormatUint(index, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	e := &api.Event{}
+	if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPICacheLookup(t *testing.T) {
+	c := newAPICache(time.Minute)
+
+	if _, fresh := c.lookup("/a"); fresh {
+		t.Fatal("empty cache returned a fresh entry")
+	}
+
+	c.store("/a", &apiEntry{fetched: time.Now(), generation: c.current()})
+	if _, fresh := c.lookup("/a"); !fresh {
+		t.Fatal("expected a fresh entry")
+	}
+
+	c.invalidate()
+	e, fresh := c.lookup("/a")
+	if fresh {
+		t.Fatal("expected entry to expire on invalidate")
+	}
+	if e == nil {
+		t.Fatal("expected expired entry to be kept")
+	}
+
+	c.store("/b", &apiEntry{fetched: time.Now().Add(-2 * time.Minute), generation: c.current()})
+	if _, fresh := c.lookup("/b"); fresh {
+		t.Fatal("expected entry older than refresh to expire")
+	}
+}
+
+// testCacheServer returns a server with a cache in front of handler.
+func testCacheServer(t *testing.T, handler http.HandlerFunc) (*Server, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+	s, err := New(Endpoint(ts.URL), CacheRefresh(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ts
+}
+
+func TestAPICacheGet(t *testing.T) {
+	var requests int32
+	var down int32
+	s, ts := testCacheServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case atomic.LoadInt32(&down) == 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			_, _ = w.Write([]byte(`"ok"`))
+		}
+	})
+	defer ts.Close()
+
+	tests := []struct {
+		desc       string
+		uri        string
+		invalidate bool
+		down       bool
+		requests   int32
+		err        error
+	}{
+		{"first fetch", "/a", false, false, 1, nil},
+		{"cached", "/a", false, false, 1, nil},
+		{"invalidated", "/a", true, false, 2, nil},
+		{"cached again", "/a", false, false, 2, nil},
+		{"not found", "/missing", false, false, 3, NotFoundError},
+		{"not found cached", "/missing", false, false, 3, NotFoundError},
+		{"stale when down", "/a", true, true, 4, nil},
+		{"uncached when down", "/b", false, true, 5, nil},
+	}
+
+	for _, tt := range tests {
+		if tt.invalidate {
+			s.apiCache.invalidate()
+		}
+		if tt.down {
+			atomic.StoreInt32(&down, 1)
+		}
+
+		var v string
+		err := s.get(tt.uri, &v)
+
+		if got := atomic.LoadInt32(&requests); got != tt.requests {
+			t.Errorf("%s: expected %d requests, got %d", tt.desc, tt.requests, got)
+		}
+
+		switch {
+		case tt.uri == "/b":
+			if err == nil {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+		case err != tt.err:
+			t.Errorf("%s: expected error %v, got %v", tt.desc, tt.err, err)
+		case err == nil && v != "ok":
+			t.Errorf("%s: unexpected value %q", tt.desc, v)
+		}
+	}
+}
+
+func TestAPICacheInvalidateDuringFetch(t *testing.T) {
+	var s *Server
+	var requests int32
+	s, ts := testCacheServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// the registry changes while this response is in flight.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			s.apiCache.invalidate()
+		}
+		_, _ = w.Write([]byte(`"ok"`))
+	})
+	defer ts.Close()
+
+	var v string
+	if err := s.get("/a", &v); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.get("/a", &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("expected response fetched before invalidation to expire, got %d requests", got)
+	}
+}
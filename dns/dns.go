@@ -2,23 +2,62 @@ package dns
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/api"
 	d "github.com/miekg/dns"
 )
 
 type (
 	Server struct {
-		address  string
-		endpoint string
-		client   *http.Client
-		domain   string
-		ttl      uint32
-		server   *d.Server
+		address        string
+		endpoint       string
+		client         *http.Client
+		domain         string
+		ttl            uint32
+		reverse        bool
+		nameservers    []string
+		nsAddresses    []net.IP
+		negativeTTL    uint32
+		serial         uint32 // tracks the registry index
+		forwarders     []string
+		cache          *forwardCache
+		refresh        time.Duration
+		watch          bool
+		apiCache       *apiCache
+		node           *api.Node
+		locality       map[string]string
+		localOnly      bool
+		dohAddress     string
+		dohCert        string
+		dohKey         string
+		transferACL    []*net.IPNet
+		notify         []string
+		filter         map[string]string
+		views          []*view
+		zones          []*zone
+		children       []*Server
+		logger         *log.Logger
+		queryLog       bool
+		metrics        *metrics
+		metricsAddress string
+		mdnsEnabled    bool
+		mdnsInterface  string
+		mdnsBrowse     time.Duration
+		mdns           *mdns
+		mux            *d.ServeMux
+		handler        d.Handler
+		server         *d.Server
+		tcpServer      *d.Server
+
+		notifyPending chan struct{}
 	}
 
 	OptionFunc func(*Server) error
@@ -33,6 +72,11 @@ const (
 	DefaultDomain = "onedari.local."
 	// DefaultTTL is the default DNS ttl.
 	DefaultTTL = 0
+	// DefaultNegativeTTL is the default time resolvers may cache negative
+	// answers, from the SOA minimum.
+	DefaultNegativeTTL = 30
+	// DefaultCacheRefresh is the default age at which cached API responses are refreshed.
+	DefaultCacheRefresh = 30 * time.Second
 )
 
 const (
@@ -40,6 +84,7 @@ const (
 	UnknownQueryType = iota
 	NodeQueryType
 	ServiceQueryType
+	InstanceQueryType
 )
 
 // Endpoint sets the API endpoint.
@@ -50,6 +95,19 @@ func Endpoint(endpoint string) OptionFunc {
 	}
 }
 
+// Address sets the UDP and TCP listen address. Default is DefaultAddress.
+// Use port 53 on a reachable address to serve other hosts or to be used
+// from /etc/resolv.conf, which cannot set a port.
+func Address(addr string) OptionFunc {
+	return func(s *Server) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %s: %s", addr, err)
+		}
+		s.address = addr
+		return nil
+	}
+}
+
 // HTTPClient sets the http client to use.
 func HTTPClient(client *http.Client) OptionFunc {
 	return func(s *Server) error {
@@ -76,13 +134,276 @@ func TTL(ttl uint32) OptionFunc {
 	}
 }
 
+// Reverse enables answering PTR queries in the in-addr.arpa and ip6.arpa
+// zones for node and instance addresses.
+func Reverse(reverse bool) OptionFunc {
+	return func(s *Server) error {
+		s.reverse = reverse
+		return nil
+	}
+}
+
+// Nameservers sets the names used in the NS and SOA records for the
+// domain. Default is "ns.<domain>".
+func Nameservers(names []string) OptionFunc {
+	return func(s *Server) error {
+		s.nameservers = make([]string, 0, len(names))
+		for _, n := range names {
+			if n == "" {
+				continue
+			}
+			s.nameservers = append(s.nameservers, d.Fqdn(strings.ToLower(n)))
+		}
+		return nil
+	}
+}
+
+// NameserverAddresses sets the addresses of nameservers within the
+// domain, used as glue. Default is the listen address.
+func NameserverAddresses(addrs []string) OptionFunc {
+	return func(s *Server) error {
+		s.nsAddresses = make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			a = strings.TrimSpace(a)
+			if a == "" {
+				continue
+			}
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return fmt.Errorf("invalid address: %s", a)
+			}
+			s.nsAddresses = append(s.nsAddresses, ip)
+		}
+		return nil
+	}
+}
+
+// NegativeTTL sets how long resolvers may cache negative answers, in
+// seconds.
+func NegativeTTL(ttl uint32) OptionFunc {
+	return func(s *Server) error {
+		s.negativeTTL = ttl
+		return nil
+	}
+}
+
+// Forwarders sets the upstream resolvers used for names outside of the
+// domain. Each is a "host:port"; the port defaults to 53.
+func Forwarders(addrs []string) OptionFunc {
+	return func(s *Server) error {
+		s.forwarders = make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			a = strings.TrimSpace(a)
+			if a == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(a); err != nil {
+				a = net.JoinHostPort(a, "53")
+			}
+			s.forwarders = append(s.forwarders, a)
+		}
+		return nil
+	}
+}
+
+// CacheRefresh sets how long API responses are cached. 0 disables the cache.
+func CacheRefresh(refresh time.Duration) OptionFunc {
+	return func(s *Server) error {
+		s.refresh = refresh
+		return nil
+	}
+}
+
+// Watch sets whether to invalidate cached API responses when the registry
+// changes.
+func Watch(watch bool) OptionFunc {
+	return func(s *Server) error {
+		s.watch = watch
+		return nil
+	}
+}
+
+// Node sets the node the server is running on. Instances on this node
+// are preferred in answers.
+func Node(n *api.Node) OptionFunc {
+	return func(s *Server) error {
+		s.node = n
+		return nil
+	}
+}
+
+// Locality sets labels, such as a zone, that are preferred in answers
+// after instances on this node.
+func Locality(labels map[string]string) OptionFunc {
+	return func(s *Server) error {
+		s.locality = labels
+		return nil
+	}
+}
+
+// LocalOnly sets whether to only answer with the closest instances rather
+// than ordering them first.
+func LocalOnly(localOnly bool) OptionFunc {
+	return func(s *Server) error {
+		s.localOnly = localOnly
+		return nil
+	}
+}
+
+// DoHAddress sets the listen address for DNS-over-HTTPS (RFC 8484). It is
+// disabled by default.
+func DoHAddress(addr string) OptionFunc {
+	return func(s *Server) error {
+		s.dohAddress = addr
+		return nil
+	}
+}
+
+// DoHTLS sets the certificate and key files for DNS-over-HTTPS. If unset,
+// plain HTTP is used, such as behind a TLS terminating proxy.
+func DoHTLS(cert, key string) OptionFunc {
+	return func(s *Server) error {
+		if (cert == "") != (key == "") {
+			return fmt.Errorf("both certificate and key are required")
+		}
+		s.dohCert = cert
+		s.dohKey = key
+		return nil
+	}
+}
+
+// TransferACL sets the addresses or CIDRs of clients allowed to transfer
+// the zone with AXFR or IXFR. Transfers are refused by default.
+func TransferACL(cidrs []string) OptionFunc {
+	return func(s *Server) error {
+		var err error
+		s.transferACL, err = parseCIDRs(cidrs)
+		return err
+	}
+}
+
+// Notify sets the secondaries sent a NOTIFY when the registry changes.
+// Each is a "host:port"; the port defaults to 53.
+func Notify(addrs []string) OptionFunc {
+	return func(s *Server) error {
+		s.notify = make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			a = strings.TrimSpace(a)
+			if a == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(a); err != nil {
+				a = net.JoinHostPort(a, "53")
+			}
+			s.notify = append(s.notify, a)
+		}
+		return nil
+	}
+}
+
+// Zone adds a domain served from endpoint, limited to instances matching
+// query. If endpoint is empty, the server's endpoint is used.
+func Zone(domain, endpoint string, query map[string]string) OptionFunc {
+	return func(s *Server) error {
+		if domain == "" {
+			return fmt.Errorf("empty zone domain")
+		}
+		s.zones = append(s.zones, &zone{
+			domain:   d.Fqdn(strings.ToLower(domain)),
+			endpoint: endpoint,
+			query:    query,
+		})
+		return nil
+	}
+}
+
+// View answers clients in the given addresses or CIDRs with the address
+// in the instance metadata field, rather than the instance address. Views
+// are checked in the order they are added.
+func View(cidrs []string, field string) OptionFunc {
+	return func(s *Server) error {
+		if field == "" {
+			return fmt.Errorf("empty view field")
+		}
+		networks, err := parseCIDRs(cidrs)
+		if err != nil {
+			return err
+		}
+		s.views = append(s.views, &view{
+			networks: networks,
+			field:    field,
+		})
+		return nil
+	}
+}
+
+// parseCIDRs parses addresses or CIDRs. Addresses are treated as a single
+// host.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			c = fmt.Sprintf("%s/%d", c, bits)
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// Logger sets the logger. Default is the logrus standard logger.
+func Logger(l *log.Logger) OptionFunc {
+	return func(s *Server) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// QueryLog sets whether to log every query.
+func QueryLog(queryLog bool) OptionFunc {
+	return func(s *Server) error {
+		s.queryLog = queryLog
+		return nil
+	}
+}
+
+// MetricsAddress sets the listen address for Prometheus metrics at
+// /metrics. It is disabled by default.
+func MetricsAddress(addr string) OptionFunc {
+	return func(s *Server) error {
+		s.metricsAddress = addr
+		return nil
+	}
+}
+
 // New creates a new DNS Server.
 func New(options ...OptionFunc) (*Server, error) {
 	s := &Server{
-		address:  DefaultAddress,
-		endpoint: DefaultEndpoint,
-		domain:   DefaultDomain,
-		ttl:      DefaultTTL,
+		address:     DefaultAddress,
+		endpoint:    DefaultEndpoint,
+		domain:      DefaultDomain,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		cache:       newForwardCache(),
+		refresh:     DefaultCacheRefresh,
+		watch:       true,
+		logger:      log.StandardLogger(),
+		metrics:     newMetrics(),
 		client: &http.Client{
 			Timeout: time.Duration(5 * time.Second),
 		},
@@ -95,45 +416,211 @@ func New(options ...OptionFunc) (*Server, error) {
 		}
 	}
 
+	if s.mdnsBrowse > 0 && !s.mdnsEnabled {
+		return nil, fmt.Errorf("mdns browsing requires mdns")
+	}
+
+	// each additional zone is served by a copy of the server.
+	for _, z := range s.zones {
+		c := *s
+		c.domain = z.domain
+		c.filter = z.query
+		if z.endpoint != "" {
+			c.endpoint = z.endpoint
+		}
+		c.zones = nil
+		c.setup()
+		s.children = append(s.children, &c)
+	}
+
+	s.setup()
+
+	if err := s.checkGlue(); err != nil {
+		return nil, err
+	}
+
+	s.mux = d.NewServeMux()
+	s.mux.Handle(s.domain, s)
+
+	for _, c := range s.children {
+		c.mux = s.mux
+		s.mux.Handle(c.domain, c)
+	}
+
+	// only the main domain is advertised.
+	if s.mdnsEnabled {
+		s.mdns = newMDNS(s.mdnsInterface, s.mdnsBrowse)
+	}
+
+	s.handler = s.instrument(s.mux)
+	s.registerCacheStats()
+
+	if s.reverse {
+		s.mux.HandleFunc(reverseIPv4Domain, s.ServeReverse)
+		s.mux.HandleFunc(reverseIPv6Domain, s.ServeReverse)
+	}
+
+	if len(s.forwarders) > 0 {
+		s.mux.HandleFunc(".", s.ServeForward)
+	}
+
 	return s, nil
 }
 
+// setup sets the defaults that depend on the domain and endpoint.
+func (s *Server) setup() {
+	if s.refresh > 0 {
+		s.apiCache = newAPICache(s.refresh)
+	}
+
+	if len(s.nameservers) == 0 {
+		s.nameservers = []string{"ns." + s.domain}
+	}
+
+	if len(s.nsAddresses) == 0 {
+		if host, _, err := net.SplitHostPort(s.address); err == nil {
+			if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+				s.nsAddresses = []net.IP{ip}
+			}
+		}
+	}
+
+	s.notifyPending = make(chan struct{}, 1)
+}
+
+// start starts the background work for a single domain.
+func (s *Server) start() {
+	// best effort. the watch will update it on the next change.
+	index := &api.Index{}
+	if err := s.DoHTTP("/v0/index", index); err == nil {
+		atomic.StoreUint32(&s.serial, uint32(index.Index))
+	}
+
+	if s.watch {
+		go s.watchAPI()
+	}
+
+	if len(s.notify) > 0 {
+		go s.sendNotifies()
+	}
+}
+
 // Run starts the server.  It does not return, generally.
 func (s *Server) Run() error {
-	d.Handle(s.domain, s)
+	s.start()
+	for _, c := range s.children {
+		c.start()
+	}
 
 	s.server = &d.Server{
 		Addr:         s.address,
 		Net:          "udp",
+		Handler:      s.handler,
+		ReadTimeout:  10 * time.Second, // configurable??
+		WriteTimeout: 10 * time.Second, // configurable??
+	}
+
+	// tcp is needed for zone transfers and large responses.
+	s.tcpServer = &d.Server{
+		Addr:         s.address,
+		Net:          "tcp",
+		Handler:      s.handler,
 		ReadTimeout:  10 * time.Second, // configurable??
 		WriteTimeout: 10 * time.Second, // configurable??
 	}
 
-	return s.server.ListenAndServe()
+	errs := make(chan error, 5)
+
+	if s.metricsAddress != "" {
+		go func() {
+			errs <- s.runMetrics()
+		}()
+	}
+
+	go func() {
+		errs <- s.tcpServer.ListenAndServe()
+	}()
+
+	if s.dohAddress != "" {
+		go func() {
+			errs <- s.runDoH()
+		}()
+	}
+
+	if s.mdns != nil {
+		go func() {
+			errs <- s.runMDNS()
+		}()
+	}
+
+	go func() {
+		errs <- s.server.ListenAndServe()
+	}()
+
+	return <-errs
 }
 
-// getQueryType gets query type.
+// getQueryType gets query type. name is empty for the sub-domain itself,
+// such as "services."
 func getQueryType(name string) (int, string, error) {
 	parts := strings.Split(name, ".")
 	// pop blank field
 	parts = parts[:len(parts)-1]
-	if len(parts) != 2 {
+
+	var sub string
+	switch len(parts) {
+	case 1:
+		sub, name = parts[0], ""
+	case 2:
+		sub, name = parts[1], parts[0]
+	default:
 		return UnknownQueryType, "", fmt.Errorf("incorrect length of name: %s", name)
 	}
-	switch parts[1] {
+
+	switch sub {
 	case "services":
-		return ServiceQueryType, parts[0], nil
+		return ServiceQueryType, name, nil
 	case "nodes":
-		return NodeQueryType, parts[0], nil
+		return NodeQueryType, name, nil
+	case "instances":
+		return InstanceQueryType, name, nil
 	default:
-		return UnknownQueryType, "", fmt.Errorf("unknown sub-domain: %s", parts[1])
+		return UnknownQueryType, "", fmt.Errorf("unknown sub-domain: %s", sub)
+	}
+}
+
+// getQueryURI returns the API path used to look up name.
+func getQueryURI(queryType int, name string) string {
+	switch queryType {
+	case ServiceQueryType:
+		return "/v0/services/" + name
+	case NodeQueryType:
+		return "/v0/nodes/" + name
+	case InstanceQueryType:
+		return "/v0/instances/" + name
 	}
+	return ""
 }
 
 // ServeDNS implements the dns.Server interface.
 func (s *Server) ServeDNS(w d.ResponseWriter, r *d.Msg) {
 	// get just the query in lowercase
-	query := strings.TrimSuffix(strings.ToLower(r.Question[0].Name), s.domain)
+	query := strings.TrimSuffix(strings.ToLower(r.Question[0].Name), strings.ToLower(s.domain))
+
+	if s.isNameserver(r.Question[0].Name) {
+		s.NameserverQuery(w, r)
+		return
+	}
+
+	if query == "" {
+		switch r.Question[0].Qtype {
+		case d.TypeAXFR, d.TypeIXFR:
+			s.Transfer(w, r)
+		default:
+			s.ApexQuery(w, r)
+		}
+		return
+	}
 
 	queryType, name, err := getQueryType(query)
 
@@ -142,6 +629,12 @@ func (s *Server) ServeDNS(w d.ResponseWriter, r *d.Msg) {
 		return
 	}
 
+	// sub-domains exist, but have no records of their own
+	if name == "" {
+		s.sendNoData(w, r)
+		return
+	}
+
 	qType := r.Question[0].Qtype
 
 	// this is a bit clumsy
@@ -160,16 +653,142 @@ func (s *Server) ServeDNS(w d.ResponseWriter, r *d.Msg) {
 		case ServiceQueryType:
 			s.ServiceQuerySRV(name, w, r)
 			return
-		default:
-			s.sendError(w, r, fmt.Errorf("invalid query type for SRV: %s", query), d.RcodeNameError)
+		}
+	case d.TypeTXT:
+		switch queryType {
+		case ServiceQueryType:
+			s.ServiceQueryTXT(name, w, r)
+			return
+		case InstanceQueryType:
+			s.InstanceQueryTXT(name, w, r)
 			return
 		}
+	}
+
+	// the name may exist without records of this type
+	s.NoDataQuery(queryType, name, w, r)
+}
+
+// ApexQuery answers queries for the domain itself.
+func (s *Server) ApexQuery(w d.ResponseWriter, r *d.Msg) {
+	m := s.reply(r)
+
+	switch r.Question[0].Qtype {
+	case d.TypeSOA:
+		m.Answer = []d.RR{s.soa()}
+	case d.TypeNS:
+		m.Answer = s.ns()
+		m.Extra = s.glue()
 	default:
-		// unknown query type
-		s.sendError(w, r, fmt.Errorf("unhandled query type: %s", qType), d.RcodeNameError)
+		m.Ns = s.authority(r)
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+// NoDataQuery answers NODATA if the name exists and NXDOMAIN if it does not.
+func (s *Server) NoDataQuery(queryType int, name string, w d.ResponseWriter, r *d.Msg) {
+	var v interface{}
+	if err := s.get(getQueryURI(queryType, name), &v); err != nil {
+		s.sendError(w, r, err, errorCode(err))
 		return
 	}
+	s.sendNoData(w, r)
+}
+
+// NameserverQuery answers queries for nameservers within the domain with
+// their glue addresses.
+func (s *Server) NameserverQuery(w d.ResponseWriter, r *d.Msg) {
+	m := s.reply(r)
+
+	question := r.Question[0]
+	for _, rr := range s.glue() {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, question.Name) && h.Rrtype == question.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = s.authority(r)
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+// isNameserver returns true if name is a nameserver within the domain.
+func (s *Server) isNameserver(name string) bool {
+	name = strings.ToLower(name)
+	for _, n := range s.nameservers {
+		if n == name && d.IsSubDomain(s.domain, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGlue returns an error if a nameserver within the domain has no
+// address to answer with.
+func (s *Server) checkGlue() error {
+	if len(s.nsAddresses) > 0 {
+		return nil
+	}
+	for _, n := range s.nameservers {
+		if d.IsSubDomain(s.domain, n) {
+			return fmt.Errorf("nameserver %s is within the domain and requires an address", n)
+		}
+	}
+	return nil
+}
+
+// glue returns the address records for nameservers within the domain.
+func (s *Server) glue() []d.RR {
+	records := []d.RR{}
+	for _, n := range s.nameservers {
+		if !d.IsSubDomain(s.domain, n) {
+			continue
+		}
+		for _, ip := range s.nsAddresses {
+			records = append(records, s.addressRR(n, ip))
+		}
+	}
+	return records
+}
 
-	// we shouldn't make it to here
-	s.sendError(w, r, fmt.Errorf("unhandled query: %s", query), d.RcodeNameError)
+// soa returns the SOA record for the domain. Resolvers cache negative
+// answers for the smaller of its TTL and minimum, so both are the negative
+// TTL.
+func (s *Server) soa() d.RR {
+	return &d.SOA{
+		Hdr: d.RR_Header{
+			Name:   s.domain,
+			Rrtype: d.TypeSOA,
+			Class:  d.ClassINET,
+			Ttl:    s.negativeTTL,
+		},
+		Ns:      s.nameservers[0],
+		Mbox:    "hostmaster." + s.domain,
+		Serial:  atomic.LoadUint32(&s.serial),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.negativeTTL,
+	}
+}
+
+// ns returns the NS records for the domain.
+func (s *Server) ns() []d.RR {
+	records := make([]d.RR, 0, len(s.nameservers))
+	for _, n := range s.nameservers {
+		records = append(records, &d.NS{
+			Hdr: d.RR_Header{
+				Name:   s.domain,
+				Rrtype: d.TypeNS,
+				Class:  d.ClassINET,
+				Ttl:    s.ttl,
+			},
+			Ns: n,
+		})
+	}
+	return records
 }
@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	d "github.com/miekg/dns"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+// dohResponseWriter captures the reply to a DNS-over-HTTPS query.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *d.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohResponseWriter) Close() error         { return nil }
+func (w *dohResponseWriter) TsigStatus() error    { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)  {}
+func (w *dohResponseWriter) Hijack()              {}
+
+func (w *dohResponseWriter) WriteMsg(m *d.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := &d.Msg{}
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (s *Server) runDoH() error {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, s)
+
+	server := &http.Server{
+		Addr:         s.dohAddress,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second, // configurable??
+		WriteTimeout: 10 * time.Second, // configurable??
+	}
+
+	if s.dohCert != "" {
+		return server.ListenAndServeTLS(s.dohCert, s.dohKey)
+	}
+	return server.ListenAndServe()
+}
+
+// ServeHTTP implements DNS-over-HTTPS (RFC 8484). Queries are answered
+// the same as over UDP. Zone transfers are refused.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch r.Method {
+	case "GET":
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, d.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &d.Msg{}
+	if err := req.Unpack(data); err != nil || len(req.Question) != 1 {
+		http.Error(w, fmt.Sprintf("invalid DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{
+		remote: httpAddr(r.RemoteAddr),
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.local = local
+	}
+
+	// a transfer is many messages, but a response carries only one.
+	if t := req.Question[0].Qtype; t == d.TypeAXFR || t == d.TypeIXFR {
+		rw.msg = &d.Msg{}
+		rw.msg.SetRcode(req, d.RcodeRefused)
+	} else {
+		s.handler.ServeDNS(rw, req)
+	}
+
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", cacheTTL(rw.msg)))
+	_, _ = w.Write(out)
+}
+
+// httpAddr converts a http.Request RemoteAddr to a net.Addr.
+func httpAddr(addr string) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	return a
+}
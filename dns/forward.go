@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	d "github.com/miekg/dns"
+)
+
+// maxForwardCacheEntries bounds the forwarding cache.
+const maxForwardCacheEntries = 10000
+
+type (
+	// forwardCache caches responses from upstream resolvers until the
+	// smallest TTL in the response expires.
+	forwardCache struct {
+		sync.Mutex
+		entries map[string]*forwardEntry
+	}
+
+	forwardEntry struct {
+		msg     *d.Msg
+		stored  time.Time
+		expires time.Time
+	}
+)
+
+func newForwardCache() *forwardCache {
+	return &forwardCache{
+		entries: make(map[string]*forwardEntry),
+	}
+}
+
+func forwardKey(q d.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// get returns a copy of the cached response with TTLs adjusted for the
+// time it has been in the cache.
+func (c *forwardCache) get(key string) *d.Msg {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if now.After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	m := e.msg.Copy()
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]d.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == d.TypeOPT {
+				continue
+			}
+			if h.Ttl > age {
+				h.Ttl -= age
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+func (c *forwardCache) set(key string, m *d.Msg) {
+	ttl := cacheTTL(m)
+	if ttl == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.entries) >= maxForwardCacheEntries {
+		// evict something. map order is random enough.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	now := time.Now()
+	c.entries[key] = &forwardEntry{
+		msg:     m.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// cacheTTL returns how long a response may be cached. Negative responses
+// use the SOA minimum, as in RFC 2308.
+func cacheTTL(m *d.Msg) uint32 {
+	if m.Truncated {
+		return 0
+	}
+	if m.Rcode != d.RcodeSuccess && m.Rcode != d.RcodeNameError {
+		return 0
+	}
+
+	var ttl uint32
+	found := false
+	min := func(v uint32) {
+		if !found || v < ttl {
+			ttl = v
+			found = true
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*d.SOA); ok {
+				min(soa.Hdr.Ttl)
+				min(soa.Minttl)
+			}
+		}
+		return ttl
+	}
+
+	for _, section := range [][]d.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == d.TypeOPT {
+				continue
+			}
+			min(rr.Header().Ttl)
+		}
+	}
+	return ttl
+}
+
+// ServeForward sends queries outside of the domain to the upstream
+// resolvers, in order, caching the responses.
+func (s *Server) ServeForward(w d.ResponseWriter, r *d.Msg) {
+	key := forwardKey(r.Question[0])
+
+	if m := s.cache.get(key); m != nil {
+		m.Id = r.Id
+		m.Truncate(maxResponseSize(w, r))
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	var (
+		resp *d.Msg
+		err  error
+	)
+	for _, upstream := range s.forwarders {
+		resp, err = s.exchange(r, upstream)
+		if err == nil {
+			break
+		}
+	}
+
+	if resp == nil {
+		s.sendError(w, r, err, d.RcodeServerFailure)
+		return
+	}
+
+	s.cache.set(key, resp)
+
+	resp.Id = r.Id
+	// the upstream answer may have come over tcp.
+	resp.Truncate(maxResponseSize(w, r))
+	_ = w.WriteMsg(resp)
+}
+
+// maxResponseSize returns the largest response the client accepts: the
+// EDNS0 buffer size over UDP, or 512 bytes without EDNS0.
+func maxResponseSize(w d.ResponseWriter, r *d.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return d.MaxMsgSize
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > d.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return d.MinMsgSize
+}
+
+// exchange sends a query to a single upstream, retrying over TCP if the
+// UDP answer was truncated.
+func (s *Server) exchange(r *d.Msg, upstream string) (*d.Msg, error) {
+	c := &d.Client{
+		Net:     "udp",
+		Timeout: 5 * time.Second, // configurable??
+	}
+
+	resp, _, err := c.Exchange(r, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(r, upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"fmt"
+
+	"github.com/bakins/onedari/api"
+	d "github.com/miekg/dns"
+)
+
+// InstanceQueryTXT answers with the labels and metadata of a single instance.
+func (s *Server) InstanceQueryTXT(name string, w d.ResponseWriter, r *d.Msg) {
+	instance := &api.Instance{}
+
+	if err := s.get("/v0/instances/"+name, instance); err != nil {
+		s.sendError(w, r, err, errorCode(err))
+		return
+	}
+
+	if !api.LabelMatches(instance.Labels, s.filter) {
+		s.sendError(w, r, fmt.Errorf("instance does not match filter: %s", name), d.RcodeNameError)
+		return
+	}
+
+	m := s.reply(r)
+
+	question := r.Question[0]
+
+	m.Answer = []d.RR{
+		&d.TXT{
+			Hdr: d.RR_Header{
+				Name:   question.Name,
+				Rrtype: question.Qtype,
+				Class:  question.Qclass,
+				Ttl:    s.ttl,
+			},
+			Txt: txtStrings(instance.Labels, instance.Metadata),
+		},
+	}
+
+	_ = w.WriteMsg(m)
+}
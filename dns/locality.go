@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"github.com/bakins/onedari/api"
+)
+
+// locality tiers, best first.
+const (
+	nodeLocality = iota
+	labelLocality
+	remoteLocality
+)
+
+// getLocality returns how close an instance is to this server.
+func (s *Server) getLocality(i *api.Instance) int {
+	if s.node != nil && i.Node == s.node.ID {
+		return nodeLocality
+	}
+
+	if len(s.locality) > 0 && api.LabelMatches(i.Labels, s.locality) {
+		return labelLocality
+	}
+
+	return remoteLocality
+}
+
+// orderByLocality returns instances on this node first, then those
+// matching the locality labels, then everything else. If localOnly is
+// set, only the closest tier that has instances is returned.
+func (s *Server) orderByLocality(instances []*api.Instance) []*api.Instance {
+	if s.node == nil && len(s.locality) == 0 {
+		return instances
+	}
+
+	tiers := make([][]*api.Instance, remoteLocality+1)
+	for _, i := range instances {
+		l := s.getLocality(i)
+		tiers[l] = append(tiers[l], i)
+	}
+
+	ordered := make([]*api.Instance, 0, len(instances))
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		ordered = append(ordered, tier...)
+		if s.localOnly {
+			break
+		}
+	}
+	return ordered
+}
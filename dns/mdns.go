@@ -0,0 +1,641 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakins/onedari/api"
+	d "github.com/miekg/dns"
+)
+
+const (
+	mdnsAddress  = "224.0.0.251:5353"
+	mdnsPort     = 5353
+	mdnsDomain   = "local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	// RFC 6762 section 10
+	mdnsHostTTL = 120
+	mdnsTTL     = 4500
+	// legacy unicast responses must not be cached long
+	mdnsLegacyTTL = 10
+	mdnsMaxSize   = 9000
+
+	// cache flush bit of the class of unique records and the unicast
+	// response bit of the class of questions.
+	mdnsClassBit = 1 << 15
+
+	// imported instances are removed when not seen for this many browses.
+	mdnsExpire = 3
+
+	// records are rebuilt at least this often, in case a change was
+	// missed, such as when the watch is disabled.
+	mdnsRefresh = time.Minute
+)
+
+type (
+	// mdns is the state of the multicast DNS responder.
+	mdns struct {
+		sync.Mutex
+		iface  string
+		browse time.Duration
+		conn   *net.UDPConn
+		group  *net.UDPAddr
+
+		// instance names we advertise, so we do not import ourselves.
+		own map[string]bool
+
+		// the records we advertise, rebuilt when the registry changes.
+		records []d.RR
+		changed chan struct{}
+
+		// browse results
+		types    map[string]bool
+		ptrs     map[string]string // instance name -> service type
+		srvs     map[string]*d.SRV
+		txts     map[string][]string
+		hosts    map[string]net.IP
+		imported map[string]*imported // by instance ID
+	}
+
+	// imported is a foreign instance found by browsing.
+	imported struct {
+		name     string // mDNS instance name
+		instance *api.Instance
+		seen     time.Time // last in a response
+		put      time.Time // last sent to the API
+	}
+)
+
+// MDNS sets whether to advertise services as _<service>._tcp.local.
+// DNS-SD records over multicast DNS.
+func MDNS(enabled bool) OptionFunc {
+	return func(s *Server) error {
+		s.mdnsEnabled = enabled
+		return nil
+	}
+}
+
+// MDNSInterface sets the interface for multicast DNS. Default is the system
+// default.
+func MDNSInterface(iface string) OptionFunc {
+	return func(s *Server) error {
+		if iface != "" {
+			if _, err := net.InterfaceByName(iface); err != nil {
+				return err
+			}
+		}
+		s.mdnsInterface = iface
+		return nil
+	}
+}
+
+// MDNSBrowse sets how often to browse multicast DNS for foreign services
+// to import as instances. 0, the default, disables it.
+func MDNSBrowse(interval time.Duration) OptionFunc {
+	return func(s *Server) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid interval: %s", interval)
+		}
+		s.mdnsBrowse = interval
+		return nil
+	}
+}
+
+func newMDNS(iface string, browse time.Duration) *mdns {
+	return &mdns{
+		iface:    iface,
+		browse:   browse,
+		own:      make(map[string]bool),
+		changed:  make(chan struct{}, 1),
+		types:    make(map[string]bool),
+		ptrs:     make(map[string]string),
+		srvs:     make(map[string]*d.SRV),
+		txts:     make(map[string][]string),
+		hosts:    make(map[string]net.IP),
+		imported: make(map[string]*imported),
+	}
+}
+
+// runMDNS answers multicast DNS queries.  It does not return, generally.
+func (s *Server) runMDNS() error {
+	m := s.mdns
+
+	var err error
+	m.group, err = net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return err
+	}
+
+	var ifi *net.Interface
+	if m.iface != "" {
+		ifi, err = net.InterfaceByName(m.iface)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.conn, err = net.ListenMulticastUDP("udp4", ifi, m.group)
+	if err != nil {
+		return err
+	}
+	defer m.conn.Close()
+
+	go s.announceMDNS()
+
+	if m.browse > 0 {
+		go s.browseMDNS()
+	}
+
+	buf := make([]byte, mdnsMaxSize)
+	for {
+		n, src, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		msg := &d.Msg{}
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		if msg.Response {
+			if m.browse > 0 {
+				s.importMDNS(msg)
+			}
+			continue
+		}
+
+		if err := s.answerMDNS(msg, src); err != nil {
+			s.logger.WithError(err).Debug("mdns query failed")
+		}
+	}
+}
+
+// mdnsRecords builds the DNS-SD records of all services.
+func (s *Server) mdnsRecords() ([]d.RR, error) {
+	services := []*api.Service{}
+	if err := s.get("/v0/services", &services); err != nil && err != NotFoundError {
+		return nil, err
+	}
+
+	records := []d.RR{}
+	own := make(map[string]bool)
+	hosts := make(map[string]bool)
+
+	for _, summary := range services {
+		v := &api.Service{}
+		if err := s.get("/v0/services/"+summary.ID, v); err != nil {
+			if err == NotFoundError {
+				continue
+			}
+			return nil, err
+		}
+
+		serviceType := "_" + strings.ToLower(v.ID) + "._tcp." + mdnsDomain
+
+		records = append(records, &d.PTR{
+			Hdr: d.RR_Header{Name: mdnsServices, Rrtype: d.TypePTR, Class: d.ClassINET, Ttl: mdnsTTL},
+			Ptr: serviceType,
+		})
+
+		for _, r := range s.srvRecords(nil, v, mdnsHostName) {
+			name := mdnsLabel(r.instance.ID) + "." + serviceType
+			own[name] = true
+
+			records = append(records, &d.PTR{
+				Hdr: d.RR_Header{Name: serviceType, Rrtype: d.TypePTR, Class: d.ClassINET, Ttl: mdnsTTL},
+				Ptr: name,
+			})
+
+			r.srv.Hdr = d.RR_Header{Name: name, Rrtype: d.TypeSRV, Class: d.ClassINET | mdnsClassBit, Ttl: mdnsHostTTL}
+			records = append(records, r.srv)
+
+			records = append(records, &d.TXT{
+				Hdr: d.RR_Header{Name: name, Rrtype: d.TypeTXT, Class: d.ClassINET | mdnsClassBit, Ttl: mdnsTTL},
+				Txt: txtStrings(r.instance.Labels, r.instance.Metadata),
+			})
+
+			if !hosts[r.srv.Target] {
+				hosts[r.srv.Target] = true
+				r.address.Header().Class = d.ClassINET | mdnsClassBit
+				r.address.Header().Ttl = mdnsHostTTL
+				records = append(records, r.address)
+			}
+		}
+	}
+
+	s.mdns.Lock()
+	s.mdns.own = own
+	s.mdns.Unlock()
+
+	return records, nil
+}
+
+// answerMDNS answers the questions we have records for. Unlike unicast
+// DNS, nothing is sent when there are none.
+func (s *Server) answerMDNS(req *d.Msg, src *net.UDPAddr) error {
+	s.mdns.Lock()
+	records := s.mdns.records
+	s.mdns.Unlock()
+
+	m := &d.Msg{}
+	m.Response = true
+	m.Authoritative = true
+
+	unicast := false
+	for _, q := range req.Question {
+		if q.Qclass&mdnsClassBit != 0 {
+			unicast = true
+		}
+		for _, rr := range records {
+			h := rr.Header()
+			if strings.EqualFold(h.Name, q.Name) && (q.Qtype == d.TypeANY || q.Qtype == h.Rrtype) {
+				m.Answer = appendRR(m.Answer, rr)
+			}
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		return nil
+	}
+
+	m.Extra = mdnsAdditional(records, m.Answer)
+
+	dst := s.mdns.group
+
+	// a legacy resolver sending from another port gets a plain unicast
+	// response. RFC 6762 section 6.7
+	if src.Port != mdnsPort {
+		m.Id = req.Id
+		m.Question = req.Question
+		for n, rr := range m.Answer {
+			m.Answer[n] = legacyRR(rr)
+		}
+		for n, rr := range m.Extra {
+			m.Extra[n] = legacyRR(rr)
+		}
+		dst = src
+	} else if unicast {
+		dst = src
+	}
+
+	return s.sendMDNS(m, dst)
+}
+
+// legacyRR returns a copy of rr for a legacy unicast response, without
+// the cache flush bit and with a short TTL.
+func legacyRR(rr d.RR) d.RR {
+	rr = d.Copy(rr)
+	rr.Header().Class &^= mdnsClassBit
+	if rr.Header().Ttl > mdnsLegacyTTL {
+		rr.Header().Ttl = mdnsLegacyTTL
+	}
+	return rr
+}
+
+// mdnsAdditional returns the records for the targets of answers: the SRV
+// and TXT of a PTR and the address of an SRV.
+func mdnsAdditional(records, answers []d.RR) []d.RR {
+	extra := []d.RR{}
+
+	names := make(map[string]bool)
+	for _, rr := range answers {
+		if ptr, ok := rr.(*d.PTR); ok {
+			names[strings.ToLower(ptr.Ptr)] = true
+		}
+	}
+	for _, rr := range records {
+		if names[strings.ToLower(rr.Header().Name)] && !containsRR(answers, rr) {
+			extra = appendRR(extra, rr)
+		}
+	}
+
+	targets := make(map[string]bool)
+	for _, rr := range append(answers, extra...) {
+		if srv, ok := rr.(*d.SRV); ok {
+			targets[strings.ToLower(srv.Target)] = true
+		}
+	}
+	for _, rr := range records {
+		t := rr.Header().Rrtype
+		if (t == d.TypeA || t == d.TypeAAAA) && targets[strings.ToLower(rr.Header().Name)] && !containsRR(answers, rr) {
+			extra = appendRR(extra, rr)
+		}
+	}
+
+	return extra
+}
+
+// announceMDNS sends all records unsolicited at startup, twice, one
+// second apart, and then the changes whenever the registry changes. RFC
+// 6762 section 8.3. It does not return.
+func (s *Server) announceMDNS() {
+	for n := 0; n < 2; n++ {
+		if n > 0 {
+			time.Sleep(time.Second)
+		}
+		if err := s.updateMDNS(true); err != nil {
+			s.logger.WithError(err).Warn("mdns announcement failed")
+		}
+	}
+
+	ticker := time.NewTicker(mdnsRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.mdns.changed:
+		case <-ticker.C:
+		}
+		if err := s.updateMDNS(false); err != nil {
+			s.logger.WithError(err).Warn("mdns announcement failed")
+		}
+	}
+}
+
+// updateMDNS rebuilds the records we advertise and announces them, all of
+// them or only those that changed. Removed records are announced with a
+// TTL of 0 so peers forget them. RFC 6762 section 10.1
+func (s *Server) updateMDNS(all bool) error {
+	records, err := s.mdnsRecords()
+	if err != nil {
+		return err
+	}
+
+	m := s.mdns
+	m.Lock()
+	old := m.records
+	m.records = records
+	m.Unlock()
+
+	answers := []d.RR{}
+	for _, rr := range records {
+		if all || !containsRR(old, rr) {
+			answers = append(answers, rr)
+		}
+	}
+	for _, rr := range old {
+		if !containsRR(records, rr) {
+			rr = d.Copy(rr)
+			rr.Header().Ttl = 0
+			answers = append(answers, rr)
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil
+	}
+
+	msg := &d.Msg{}
+	msg.Response = true
+	msg.Authoritative = true
+	msg.Answer = answers
+
+	return s.sendMDNS(msg, m.group)
+}
+
+func (s *Server) sendMDNS(m *d.Msg, dst *net.UDPAddr) error {
+	m.Truncate(mdnsMaxSize)
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = s.mdns.conn.WriteToUDP(data, dst)
+	return err
+}
+
+// browseMDNS queries for service types and their instances and expires
+// imported instances that are no longer seen.  It does not return.
+func (s *Server) browseMDNS() {
+	m := s.mdns
+	for {
+		q := &d.Msg{}
+		q.Question = []d.Question{{Name: mdnsServices, Qtype: d.TypePTR, Qclass: d.ClassINET}}
+
+		m.Lock()
+		for t := range m.types {
+			q.Question = append(q.Question, d.Question{Name: t, Qtype: d.TypePTR, Qclass: d.ClassINET})
+		}
+		m.Unlock()
+
+		if err := s.sendMDNS(q, m.group); err != nil {
+			s.logger.WithError(err).Warn("mdns browse failed")
+		}
+
+		time.Sleep(m.browse)
+
+		for _, id := range m.expire(time.Now()) {
+			go s.deleteImported(id)
+		}
+	}
+}
+
+// expire forgets imported instances that have not been seen recently and
+// returns their IDs.
+func (m *mdns) expire(now time.Time) []string {
+	m.Lock()
+	defer m.Unlock()
+
+	ids := []string{}
+	for id, i := range m.imported {
+		if now.Sub(i.seen) > mdnsExpire*m.browse {
+			m.forget(i.name)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// forget removes the browse results and import of an instance name, so it
+// is only imported again when it is announced again. The lock must be
+// held.
+func (m *mdns) forget(name string) {
+	delete(m.ptrs, name)
+	delete(m.srvs, name)
+	delete(m.txts, name)
+	delete(m.imported, importedID(name))
+
+	// hosts are shared by instances.
+	used := make(map[string]bool, len(m.srvs))
+	for _, srv := range m.srvs {
+		used[strings.ToLower(srv.Target)] = true
+	}
+	for host := range m.hosts {
+		if !used[host] {
+			delete(m.hosts, host)
+		}
+	}
+}
+
+// importMDNS records the answers in a response and imports the instances
+// in it that are now complete. Only instances in the response are
+// refreshed.
+func (s *Server) importMDNS(msg *d.Msg) {
+	m := s.mdns
+	m.Lock()
+	defer m.Unlock()
+
+	goodbye := []string{}
+	// instance names and hosts in this response
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+
+		switch v := rr.(type) {
+		case *d.PTR:
+			ptr := strings.ToLower(v.Ptr)
+			if name == mdnsServices {
+				if strings.HasSuffix(ptr, "._tcp."+mdnsDomain) {
+					m.types[ptr] = true
+				}
+				continue
+			}
+			if !strings.HasSuffix(name, "._tcp."+mdnsDomain) {
+				continue
+			}
+			if h.Ttl == 0 {
+				goodbye = append(goodbye, ptr)
+				continue
+			}
+			m.types[name] = true
+			m.ptrs[ptr] = name
+			names[ptr] = true
+		case *d.SRV:
+			if h.Ttl == 0 {
+				goodbye = append(goodbye, name)
+				continue
+			}
+			m.srvs[name] = v
+			names[name] = true
+		case *d.TXT:
+			m.txts[name] = v.Txt
+			names[name] = true
+		case *d.A:
+			m.hosts[name] = v.A
+			hosts[name] = true
+		case *d.AAAA:
+			if _, ok := m.hosts[name]; !ok {
+				m.hosts[name] = v.AAAA
+			}
+			hosts[name] = true
+		}
+	}
+
+	for _, name := range goodbye {
+		id := importedID(name)
+		if _, ok := m.imported[id]; ok {
+			go s.deleteImported(id)
+		}
+		m.forget(name)
+		delete(names, name)
+	}
+
+	now := time.Now()
+	for name, serviceType := range m.ptrs {
+		if m.own[name] {
+			continue
+		}
+
+		srv, ok := m.srvs[name]
+		if !ok {
+			continue
+		}
+		target := strings.ToLower(srv.Target)
+		address, ok := m.hosts[target]
+		if !ok {
+			continue
+		}
+
+		prev, known := m.imported[importedID(name)]
+
+		// an address alone may complete an instance, but does not show
+		// that one already imported is still there.
+		if !names[name] && (known || !hosts[target]) {
+			continue
+		}
+
+		i := api.NewInstance()
+		i.ID = importedID(name)
+		i.Address = address
+		i.Port = srv.Port
+		i.Up = true
+		i.Labels["app"] = strings.TrimPrefix(strings.TrimSuffix(serviceType, "._tcp."+mdnsDomain), "_")
+		i.Labels["source"] = "mdns"
+		for _, txt := range m.txts[name] {
+			parts := strings.SplitN(txt, "=", 2)
+			if len(parts) == 2 && parts[0] != "" {
+				i.Metadata[parts[0]] = parts[1]
+			}
+		}
+
+		if known && reflect.DeepEqual(prev.instance, i) && now.Sub(prev.put) < m.browse {
+			prev.seen = now
+			continue
+		}
+		m.imported[i.ID] = &imported{name: name, instance: i, seen: now, put: now}
+
+		go s.putImported(i)
+	}
+}
+
+func (s *Server) putImported(i *api.Instance) {
+	if err := s.sendHTTP("PUT", "/v0/instances/"+i.ID, i); err != nil {
+		s.logger.WithError(err).WithField("instance", i.ID).Warn("mdns import failed")
+		return
+	}
+	s.logger.WithField("instance", i.ID).Debug("imported mdns instance")
+}
+
+func (s *Server) deleteImported(id string) {
+	if err := s.sendHTTP("DELETE", "/v0/instances/"+id, nil); err != nil && err != NotFoundError {
+		s.logger.WithError(err).WithField("instance", id).Warn("mdns expire failed")
+	}
+}
+
+// importedID returns the instance ID for an mDNS instance name, such as
+// mdns-ipp-printer for "printer._ipp._tcp.local."
+func importedID(name string) string {
+	rest := strings.TrimSuffix(name, "._tcp."+mdnsDomain)
+	n := strings.LastIndex(rest, "._")
+	if n < 0 {
+		return "mdns-" + mdnsLabel(rest)
+	}
+	return "mdns-" + mdnsLabel(rest[n+2:]) + "-" + mdnsLabel(rest[:n])
+}
+
+// mdnsLabel makes s a single DNS label.
+func mdnsLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '/' || r == ' ' {
+			return '-'
+		}
+		return r
+	}, strings.ToLower(s))
+}
+
+func mdnsHostName(node string) string {
+	return mdnsLabel(node) + "." + mdnsDomain
+}
+
+func containsRR(rrs []d.RR, rr d.RR) bool {
+	for _, r := range rrs {
+		if d.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendRR(rrs []d.RR, rr d.RR) []d.RR {
+	if containsRR(rrs, rr) {
+		return rrs
+	}
+	return append(rrs, rr)
+}
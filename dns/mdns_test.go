@@ -0,0 +1,287 @@
+package dns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	d "github.com/miekg/dns"
+)
+
+// announcement is an mDNS response for an _http._tcp instance on host.
+func announcement(instance, host, ip string, ttl uint32) *d.Msg {
+	name := instance + "._http._tcp.local."
+	hdr := func(name string, t uint16) d.RR_Header {
+		return d.RR_Header{Name: name, Rrtype: t, Class: d.ClassINET, Ttl: ttl}
+	}
+
+	m := &d.Msg{}
+	m.Response = true
+	m.Answer = []d.RR{
+		&d.PTR{Hdr: hdr("_http._tcp.local.", d.TypePTR), Ptr: name},
+	}
+	m.Extra = []d.RR{
+		&d.SRV{Hdr: hdr(name, d.TypeSRV), Target: host, Port: 80},
+		&d.TXT{Hdr: hdr(name, d.TypeTXT), Txt: []string{"path=/"}},
+		&d.A{Hdr: hdr(host, d.TypeA), A: net.ParseIP(ip)},
+	}
+	return m
+}
+
+// testMDNSServer returns a server with mDNS browsing and the API requests
+// it makes, as "METHOD path".
+func testMDNSServer(t *testing.T) (*Server, chan string) {
+	requests := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.URL.Path
+	}))
+	t.Cleanup(ts.Close)
+
+	s, err := New(Endpoint(ts.URL), MDNS(true), MDNSBrowse(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, requests
+}
+
+func expectRequest(t *testing.T, requests chan string, want string) {
+	select {
+	case got := <-requests:
+		if got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %s", want)
+	}
+}
+
+func TestImportMDNS(t *testing.T) {
+	s, requests := testMDNSServer(t)
+	m := s.mdns
+
+	s.importMDNS(announcement("web", "host1.local.", "192.168.1.10", 120))
+	expectRequest(t, requests, "PUT /v0/instances/mdns-http-web")
+
+	i := m.imported["mdns-http-web"]
+	if i == nil {
+		t.Fatal("instance not imported")
+	}
+	if !i.instance.Address.Equal(net.ParseIP("192.168.1.10")) || i.instance.Port != 80 ||
+		i.instance.Labels["app"] != "http" || i.instance.Labels["source"] != "mdns" ||
+		i.instance.Metadata["path"] != "/" {
+		t.Errorf("unexpected instance: %+v", i.instance)
+	}
+
+	// other traffic does not refresh it.
+	seen := time.Now().Add(-time.Hour)
+	i.seen = seen
+	s.importMDNS(announcement("api", "host2.local.", "192.168.1.11", 120))
+	expectRequest(t, requests, "PUT /v0/instances/mdns-http-api")
+	if !m.imported["mdns-http-web"].seen.Equal(seen) {
+		t.Error("instance refreshed by a response without it")
+	}
+
+	// so it expires, and stays gone until announced again.
+	expired := m.expire(time.Now())
+	if len(expired) != 1 || expired[0] != "mdns-http-web" {
+		t.Fatalf("expected web to expire, got %v", expired)
+	}
+	if _, ok := m.ptrs["web._http._tcp.local."]; ok {
+		t.Error("expired instance still browsed")
+	}
+	if _, ok := m.hosts["host1.local."]; ok {
+		t.Error("unused host kept")
+	}
+
+	s.importMDNS(announcement("api", "host2.local.", "192.168.1.11", 120))
+	if _, ok := m.imported["mdns-http-web"]; ok {
+		t.Error("expired instance imported again without an announcement")
+	}
+
+	s.importMDNS(announcement("web", "host1.local.", "192.168.1.10", 120))
+	expectRequest(t, requests, "PUT /v0/instances/mdns-http-web")
+
+	// an address alone does not refresh it.
+	i = m.imported["mdns-http-web"]
+	i.seen = seen
+	host := &d.Msg{}
+	host.Answer = []d.RR{
+		&d.A{Hdr: d.RR_Header{Name: "host1.local.", Rrtype: d.TypeA, Class: d.ClassINET, Ttl: 120}, A: net.ParseIP("192.168.1.10")},
+	}
+	s.importMDNS(host)
+	if !m.imported["mdns-http-web"].seen.Equal(seen) {
+		t.Error("instance refreshed by its host address")
+	}
+
+	// goodbye
+	s.importMDNS(announcement("api", "host2.local.", "192.168.1.11", 0))
+	expectRequest(t, requests, "DELETE /v0/instances/mdns-http-api")
+	for name := range m.ptrs {
+		if strings.HasPrefix(name, "api.") {
+			t.Errorf("instance kept after goodbye: %s", name)
+		}
+	}
+}
+
+func TestImportMDNSPartial(t *testing.T) {
+	s, requests := testMDNSServer(t)
+	m := s.mdns
+
+	// the address of the target may come in a later response.
+	msg := announcement("web", "host1.local.", "192.168.1.10", 120)
+	msg.Extra = msg.Extra[:2]
+	s.importMDNS(msg)
+	if len(m.imported) != 0 {
+		t.Fatal("imported without an address")
+	}
+
+	host := &d.Msg{}
+	host.Answer = []d.RR{
+		&d.A{Hdr: d.RR_Header{Name: "host1.local.", Rrtype: d.TypeA, Class: d.ClassINET, Ttl: 120}, A: net.ParseIP("192.168.1.10")},
+	}
+	s.importMDNS(host)
+	expectRequest(t, requests, "PUT /v0/instances/mdns-http-web")
+}
+
+// listenMDNS points the responder at a local socket and returns the
+// messages it sends.
+func listenMDNS(t *testing.T, s *Server) func() *d.Msg {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	s.mdns.conn = conn
+	s.mdns.group = conn.LocalAddr().(*net.UDPAddr)
+
+	buf := make([]byte, mdnsMaxSize)
+	return func() *d.Msg {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil
+		}
+		m := &d.Msg{}
+		if err := m.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+}
+
+// srvTTLs returns the TTL of each SRV record by name.
+func srvTTLs(m *d.Msg) map[string]uint32 {
+	ttls := make(map[string]uint32)
+	if m == nil {
+		return ttls
+	}
+	for _, rr := range m.Answer {
+		if srv, ok := rr.(*d.SRV); ok {
+			ttls[srv.Hdr.Name] = srv.Hdr.Ttl
+		}
+	}
+	return ttls
+}
+
+func TestUpdateMDNS(t *testing.T) {
+	var requests int32
+	instance := atomic.Value{}
+	instance.Store("web1")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/v0/services":
+			_, _ = w.Write([]byte(`[{"id":"web"}]`))
+		case "/v0/services/web":
+			_, _ = w.Write([]byte(`{"id":"web","instances":[{"id":"` + instance.Load().(string) +
+				`","node":"n1","ip":"10.0.0.1","port":80,"up":true}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	s, err := New(Endpoint(ts.URL), MDNS(true), CacheRefresh(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := listenMDNS(t, s)
+
+	if err := s.updateMDNS(true); err != nil {
+		t.Fatal(err)
+	}
+	if ttls := srvTTLs(read()); len(ttls) != 1 || ttls["web1._web._tcp.local."] == 0 {
+		t.Fatalf("expected web1 announced, got %v", ttls)
+	}
+
+	// unchanged records are not announced again.
+	if err := s.updateMDNS(false); err != nil {
+		t.Fatal(err)
+	}
+	if m := read(); m != nil {
+		t.Fatalf("expected nothing announced, got %v", m)
+	}
+
+	// a removed instance is announced with a TTL of 0.
+	instance.Store("web2")
+	if err := s.updateMDNS(false); err != nil {
+		t.Fatal(err)
+	}
+	m := read()
+	ttls := srvTTLs(m)
+	if len(ttls) != 2 || ttls["web2._web._tcp.local."] == 0 {
+		t.Errorf("expected web2 announced, got %v", ttls)
+	}
+	if ttl, ok := ttls["web1._web._tcp.local."]; !ok || ttl != 0 {
+		t.Errorf("expected a goodbye for web1, got %v", ttls)
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Name == mdnsServices {
+			t.Errorf("unchanged record announced again: %s", rr)
+		}
+	}
+
+	// queries are answered without the API.
+	before := atomic.LoadInt32(&requests)
+	q := &d.Msg{}
+	q.Question = []d.Question{{Name: "_web._tcp.local.", Qtype: d.TypePTR, Qclass: d.ClassINET}}
+	if err := s.answerMDNS(q, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: mdnsPort}); err != nil {
+		t.Fatal(err)
+	}
+	answer := read()
+	if answer == nil || len(answer.Answer) != 1 {
+		t.Fatalf("expected a single answer, got %v", answer)
+	}
+	if ptr, ok := answer.Answer[0].(*d.PTR); !ok || ptr.Ptr != "web2._web._tcp.local." {
+		t.Errorf("expected web2 in the answer, got %s", answer.Answer[0])
+	}
+	if got := atomic.LoadInt32(&requests); got != before {
+		t.Errorf("expected no API requests for a query, got %d", got-before)
+	}
+}
+
+func TestUpdateMDNSEmpty(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	s, err := New(Endpoint(ts.URL), MDNS(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := listenMDNS(t, s)
+
+	if err := s.updateMDNS(true); err != nil {
+		t.Fatalf("empty registry failed: %s", err)
+	}
+	if m := read(); m != nil {
+		t.Errorf("expected nothing announced, got %v", m)
+	}
+}
@@ -0,0 +1,177 @@
+package dns
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	d "github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type (
+	metrics struct {
+		registry    *prometheus.Registry
+		queries     *prometheus.CounterVec
+		latency     prometheus.Histogram
+		apiRequests *prometheus.HistogramVec
+	}
+
+	// instrumentedWriter records the response written to the client.
+	instrumentedWriter struct {
+		d.ResponseWriter
+		msg *d.Msg
+	}
+)
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "onedari",
+				Subsystem: "dns",
+				Name:      "queries_total",
+				Help:      "DNS queries by query type and response code.",
+			},
+			[]string{"qtype", "rcode"},
+		),
+		latency: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "onedari",
+				Subsystem: "dns",
+				Name:      "query_duration_seconds",
+				Help:      "Time to answer DNS queries.",
+				Buckets:   prometheus.DefBuckets,
+			},
+		),
+		apiRequests: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "onedari",
+				Subsystem: "dns",
+				Name:      "api_request_duration_seconds",
+				Help:      "Time for requests to the onedari API by resource.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"resource"},
+		),
+	}
+
+	m.registry.MustRegister(m.queries, m.latency, m.apiRequests)
+	return m
+}
+
+// registerCacheStats exports the cache counters of the server and its
+// additional zones.
+func (s *Server) registerCacheStats() {
+	stats := func(f func(CacheStats) uint64) func() float64 {
+		return func() float64 {
+			total := f(s.CacheStats())
+			for _, c := range s.children {
+				total += f(c.CacheStats())
+			}
+			return float64(total)
+		}
+	}
+
+	s.metrics.registry.MustRegister(
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: "onedari",
+				Subsystem: "dns",
+				Name:      "cache_hits_total",
+				Help:      "API responses served from the cache.",
+			},
+			stats(func(c CacheStats) uint64 { return c.Hits }),
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: "onedari",
+				Subsystem: "dns",
+				Name:      "cache_misses_total",
+				Help:      "API responses not in the cache or expired.",
+			},
+			stats(func(c CacheStats) uint64 { return c.Misses }),
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: "onedari",
+				Subsystem: "dns",
+				Name:      "cache_stale_total",
+				Help:      "Expired API responses served because the API was unreachable.",
+			},
+			stats(func(c CacheStats) uint64 { return c.Stale }),
+		),
+	)
+}
+
+// apiResource returns the resource of an API uri, such as "services",
+// to keep the number of label values small.
+func apiResource(uri string) string {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "/"), "/", 3)
+	if len(parts) < 2 {
+		return uri
+	}
+	return strings.SplitN(parts[1], "?", 2)[0]
+}
+
+func (w *instrumentedWriter) WriteMsg(m *d.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// instrument wraps a handler to log queries and record metrics.
+func (s *Server) instrument(next d.Handler) d.Handler {
+	return d.HandlerFunc(func(w d.ResponseWriter, r *d.Msg) {
+		start := time.Now()
+		iw := &instrumentedWriter{ResponseWriter: w}
+
+		next.ServeDNS(iw, r)
+
+		duration := time.Since(start)
+
+		rcode := "NOREPLY"
+		if iw.msg != nil {
+			rcode = d.RcodeToString[iw.msg.Rcode]
+		}
+
+		var qname, qtype string
+		if len(r.Question) > 0 {
+			qname = r.Question[0].Name
+			qtype = d.TypeToString[r.Question[0].Qtype]
+		}
+
+		s.metrics.queries.WithLabelValues(qtype, rcode).Inc()
+		s.metrics.latency.Observe(duration.Seconds())
+
+		if s.queryLog {
+			var client string
+			if a := w.RemoteAddr(); a != nil {
+				client = a.String()
+			}
+
+			s.logger.WithFields(log.Fields{
+				"qname":   qname,
+				"qtype":   qtype,
+				"rcode":   rcode,
+				"latency": duration.Seconds(),
+				"client":  client,
+			}).Info("query")
+		}
+	})
+}
+
+func (s *Server) runMetrics() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Addr:         s.metricsAddress,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second, // configurable??
+		WriteTimeout: 10 * time.Second, // configurable??
+	}
+	return server.ListenAndServe()
+}
@@ -10,9 +10,8 @@ import (
 func (s *Server) NodeQuery(name string, w d.ResponseWriter, r *d.Msg) {
 	node := &api.Node{}
 
-	if err := s.DoHTTP("/v0/nodes/"+name, node); err != nil {
-		// need to check if it is not found
-		s.sendError(w, r, err, d.RcodeNameError)
+	if err := s.get("/v0/nodes/"+name, node); err != nil {
+		s.sendError(w, r, err, errorCode(err))
 		return
 	}
 	// sanity check
@@ -21,8 +20,13 @@ func (s *Server) NodeQuery(name string, w d.ResponseWriter, r *d.Msg) {
 		return
 	}
 
-	m := &d.Msg{}
-	m.SetReply(r)
+	address, err := s.nodeAddress(w, node)
+	if err != nil {
+		s.sendError(w, r, err, d.RcodeServerFailure)
+		return
+	}
+
+	m := s.reply(r)
 
 	question := r.Question[0]
 	m.Answer = []d.RR{
@@ -33,7 +37,7 @@ func (s *Server) NodeQuery(name string, w d.ResponseWriter, r *d.Msg) {
 				Class:  question.Qclass,
 				Ttl:    s.ttl,
 			},
-			A: node.Address,
+			A: address,
 		},
 	}
 
@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bakins/onedari/api"
+	d "github.com/miekg/dns"
+)
+
+const (
+	reverseIPv4Domain = "in-addr.arpa."
+	reverseIPv6Domain = "ip6.arpa."
+)
+
+// ServeReverse answers PTR queries for node and instance addresses.
+func (s *Server) ServeReverse(w d.ResponseWriter, r *d.Msg) {
+	question := r.Question[0]
+	name := strings.ToLower(question.Name)
+
+	ip, err := reverseAddress(name)
+	if err != nil {
+		s.notFoundReverse(w, r, err)
+		return
+	}
+
+	nodes := []*api.Node{}
+	if err := s.get("/v0/addresses/"+ip.String(), &nodes); err != nil {
+		s.sendError(w, r, err, d.RcodeServerFailure)
+		return
+	}
+
+	if len(nodes) == 0 {
+		s.notFoundReverse(w, r, fmt.Errorf("no nodes for address: %s", ip))
+		return
+	}
+
+	if question.Qtype != d.TypePTR {
+		s.sendNoData(w, r)
+		return
+	}
+
+	m := s.reply(r)
+
+	header := d.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  question.Qclass,
+		Ttl:    s.ttl,
+	}
+
+	m.Answer = make([]d.RR, 0, len(nodes))
+	for _, node := range nodes {
+		answer := &d.PTR{
+			Hdr: header,
+			Ptr: strings.ToLower(strings.Join([]string{node.ID, "nodes", s.domain}, ".")),
+		}
+		m.Answer = append(m.Answer, answer)
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+// notFoundReverse forwards reverse queries for addresses not in the
+// registry, if there are forwarders, so other addresses still resolve.
+func (s *Server) notFoundReverse(w d.ResponseWriter, r *d.Msg, err error) {
+	if len(s.forwarders) > 0 {
+		s.ServeForward(w, r)
+		return
+	}
+	s.sendError(w, r, err, d.RcodeNameError)
+}
+
+// reverseAddress converts an in-addr.arpa or ip6.arpa name to an address.
+func reverseAddress(name string) (net.IP, error) {
+	switch {
+	case strings.HasSuffix(name, "."+reverseIPv4Domain):
+		parts := strings.Split(strings.TrimSuffix(name, "."+reverseIPv4Domain), ".")
+		if len(parts) != net.IPv4len {
+			return nil, fmt.Errorf("incorrect length of name: %s", name)
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, p := range parts {
+			b, err := strconv.ParseUint(p, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reverse name: %s", name)
+			}
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+		return ip, nil
+
+	case strings.HasSuffix(name, "."+reverseIPv6Domain):
+		parts := strings.Split(strings.TrimSuffix(name, "."+reverseIPv6Domain), ".")
+		if len(parts) != net.IPv6len*2 {
+			return nil, fmt.Errorf("incorrect length of name: %s", name)
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, p := range parts {
+			n, err := strconv.ParseUint(p, 16, 4)
+			if err != nil || len(p) != 1 {
+				return nil, fmt.Errorf("invalid reverse name: %s", name)
+			}
+			// parts are least significant nibble first
+			pos := len(parts) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(n) << 4
+			} else {
+				ip[pos/2] |= byte(n)
+			}
+		}
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("unknown reverse domain: %s", name)
+}
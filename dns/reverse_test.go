@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReverseAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		err  bool
+	}{
+		{"4.3.2.1.in-addr.arpa.", "1.2.3.4", false},
+		{"1.0.0.127.in-addr.arpa.", "127.0.0.1", false},
+		{"255.255.255.255.in-addr.arpa.", "255.255.255.255", false},
+		{
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			"2001:db8::1", false,
+		},
+		{
+			"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.",
+			"4321:0:1:2:3:4:567:89ab", false,
+		},
+		{"3.2.1.in-addr.arpa.", "", true},
+		{"5.4.3.2.1.in-addr.arpa.", "", true},
+		{"256.3.2.1.in-addr.arpa.", "", true},
+		{"x.3.2.1.in-addr.arpa.", "", true},
+		{"in-addr.arpa.", "", true},
+		{"1.0.0.0.ip6.arpa.", "", true},
+		{
+			"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.ip6.arpa.",
+			"", true,
+		},
+		{
+			"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			"", true,
+		},
+		{"4.3.2.1.example.com.", "", true},
+	}
+
+	for _, tt := range tests {
+		ip, err := reverseAddress(tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", tt.name, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tt.ip)) {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.ip, ip)
+		}
+	}
+}
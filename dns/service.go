@@ -1,30 +1,26 @@
 package dns
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
-
 	"github.com/bakins/onedari/api"
 	d "github.com/miekg/dns"
 )
 
 const (
-	defaultMetadataInt  = 100
-	maxServiceResponses = 3 // UDP max number of responses. TODO: listen on tcp as well.
+	// maxServiceResponses is the most A records in a service answer, in
+	// locality order. Clients only use the first few, and SRV queries
+	// return every instance.
+	maxServiceResponses = 3
 )
 
 func (s *Server) ServiceQueryA(name string, w d.ResponseWriter, r *d.Msg) {
 	service := &api.Service{}
 
-	if err := s.DoHTTP("/v0/services/"+name, service); err != nil {
-		fmt.Println(err)
-		// need to check if it is not found
-		s.sendError(w, r, err, d.RcodeNameError)
+	if err := s.get("/v0/services/"+name, service); err != nil {
+		s.sendError(w, r, err, errorCode(err))
+		return
 	}
 
-	m := &d.Msg{}
-	m.SetReply(r)
+	m := s.reply(r)
 
 	question := r.Question[0]
 
@@ -37,25 +33,28 @@ func (s *Server) ServiceQueryA(name string, w d.ResponseWriter, r *d.Msg) {
 
 	m.Answer = make([]d.RR, 0, len(service.Instances))
 
-	for _, instance := range service.Instances {
-		if instance.Address == nil {
+	for _, instance := range s.instances(service) {
+		address := s.instanceAddress(w, instance).To4()
+		if address == nil {
 			continue
 		}
 		answer := &d.A{
 			Hdr: header,
-			A:   instance.Address,
+			A:   address,
 		}
 
 		m.Answer = append(m.Answer, answer)
 	}
 
-	// we are udp only. need to answer on tcp as well for large responses?
+	// the service exists, but has no up instances
+	if len(m.Answer) == 0 {
+		s.sendNoData(w, r)
+		return
+	}
+
 	if len(m.Answer) > maxServiceResponses {
-		// should we return a random number
 		m.Answer = m.Answer[:maxServiceResponses]
-		//m.Truncated = true
 	}
-	// what if we have no instances?? should we return a dns error
 
 	_ = w.WriteMsg(m)
 }
@@ -63,13 +62,12 @@ func (s *Server) ServiceQueryA(name string, w d.ResponseWriter, r *d.Msg) {
 func (s *Server) ServiceQuerySRV(name string, w d.ResponseWriter, r *d.Msg) {
 	service := &api.Service{}
 
-	if err := s.DoHTTP("/v0/services/"+name, service); err != nil {
-		fmt.Println(err)
-		s.sendError(w, r, err, d.RcodeServerFailure)
+	if err := s.get("/v0/services/"+name, service); err != nil {
+		s.sendError(w, r, err, errorCode(err))
+		return
 	}
 
-	m := &d.Msg{}
-	m.SetReply(r)
+	m := s.reply(r)
 
 	question := r.Question[0]
 
@@ -80,58 +78,98 @@ func (s *Server) ServiceQuerySRV(name string, w d.ResponseWriter, r *d.Msg) {
 		Ttl:    s.ttl,
 	}
 
-	m.Answer = make([]d.RR, 0, len(service.Instances))
-	m.Extra = make([]d.RR, 0, len(service.Instances))
+	records := s.srvRecords(w, service, s.nodeName)
 
-	for _, instance := range service.Instances {
-		if instance.Address == nil || instance.Node == "" {
-			continue
-		}
+	m.Answer = make([]d.RR, 0, len(records))
+	m.Extra = make([]d.RR, 0, len(records))
 
-		target := strings.ToLower(strings.Join([]string{instance.Node, "nodes", s.domain}, "."))
+	for _, r := range records {
+		r.srv.Hdr = header
+		m.Answer = append(m.Answer, r.srv)
+		m.Extra = append(m.Extra, r.address)
+	}
 
-		answer := &d.SRV{
-			Hdr:      header,
-			Port:     instance.Port,
-			Target:   target,
-			Weight:   getMetadataInt(instance, "weight"),
-			Priority: getMetadataInt(instance, "priority"),
-		}
+	// the service exists, but has no up instances
+	if len(m.Answer) == 0 {
+		s.sendNoData(w, r)
+		return
+	}
 
-		m.Answer = append(m.Answer, answer)
+	_ = w.WriteMsg(m)
 
-		extra := &d.A{
-			Hdr: d.RR_Header{
-				Name:   target,
-				Rrtype: d.TypeA,
-				Class:  question.Qclass,
-				Ttl:    s.ttl,
-			},
-			A: instance.Address,
+}
+
+// srvRecord is an SRV record for an instance and the address record of
+// its target.
+type srvRecord struct {
+	instance *api.Instance
+	srv      *d.SRV
+	address  d.RR
+}
+
+// srvRecords builds the SRV records of the service's instances. target
+// returns the target name of a node. Callers set the SRV owner name.
+func (s *Server) srvRecords(w d.ResponseWriter, service *api.Service, target func(string) string) []*srvRecord {
+	records := make([]*srvRecord, 0, len(service.Instances))
+
+	for _, instance := range s.instances(service) {
+		address := s.instanceAddress(w, instance)
+		if address == nil || instance.Node == "" {
+			continue
 		}
 
-		m.Extra = append(m.Extra, extra)
+		name := target(instance.Node)
 
+		records = append(records, &srvRecord{
+			instance: instance,
+			srv: &d.SRV{
+				Port:     instance.Port,
+				Target:   name,
+				Weight:   instance.MetadataInt("weight"),
+				Priority: instance.MetadataInt("priority"),
+			},
+			address: s.addressRR(name, address),
+		})
 	}
 
-	// what if we have no instances?? should we return a dns error
-	_ = w.WriteMsg(m)
-
+	return records
 }
 
-func getMetadataInt(instance *api.Instance, f string) uint16 {
-	if instance.Metadata == nil {
-		return defaultMetadataInt
+// instances returns the service instances that match the zone filter,
+// ordered by locality.
+func (s *Server) instances(service *api.Service) []*api.Instance {
+	instances := make([]*api.Instance, 0, len(service.Instances))
+	for _, i := range service.Instances {
+		if api.LabelMatches(i.Labels, s.filter) {
+			instances = append(instances, i)
+		}
 	}
-	v, ok := instance.Metadata[f]
-	if !ok {
-		return defaultMetadataInt
+	return s.orderByLocality(instances)
+}
+
+func (s *Server) ServiceQueryTXT(name string, w d.ResponseWriter, r *d.Msg) {
+	service := &api.Service{}
+
+	if err := s.get("/v0/services/"+name, service); err != nil {
+		s.sendError(w, r, err, errorCode(err))
+		return
 	}
 
-	// should we care about error here? log it?
-	if i, err := strconv.ParseUint(v, 10, 0); err == nil {
-		return uint16(i)
+	m := s.reply(r)
+
+	question := r.Question[0]
+
+	m.Answer = []d.RR{
+		&d.TXT{
+			Hdr: d.RR_Header{
+				Name:   question.Name,
+				Rrtype: question.Qtype,
+				Class:  question.Qclass,
+				Ttl:    s.ttl,
+			},
+			Txt: txtStrings(service.Labels),
+		},
 	}
 
-	return defaultMetadataInt
+	_ = w.WriteMsg(m)
 }
@@ -1,29 +1,183 @@
 package dns
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	d "github.com/miekg/dns"
 )
 
-func (s *Server) sendError(w d.ResponseWriter, req *d.Msg, err error, code int) {
+// NotFoundError is returned by DoHTTP when the API returns 404.
+var NotFoundError = errors.New("not found")
+
+// reply creates an authoritative reply to req.
+func (s *Server) reply(req *d.Msg) *d.Msg {
 	m := &d.Msg{}
-	m.SetRcode(req, code)
+	m.SetReply(req)
+	m.Authoritative = s.inZone(req)
+	return m
+}
+
+// inZone returns true if the question is within our domain.
+func (s *Server) inZone(req *d.Msg) bool {
+	return d.IsSubDomain(s.domain, req.Question[0].Name)
+}
+
+// authority returns the authority section for negative answers.
+func (s *Server) authority(req *d.Msg) []d.RR {
+	if !s.inZone(req) {
+		return nil
+	}
+	return []d.RR{s.soa()}
+}
+
+func (s *Server) sendError(w d.ResponseWriter, req *d.Msg, err error, code int) {
+	m := s.reply(req)
+	m.Rcode = code
+	if code == d.RcodeNameError {
+		m.Ns = s.authority(req)
+	}
+	_ = w.WriteMsg(m)
+
+	entry := s.logger.WithError(err).WithFields(log.Fields{
+		"qname": req.Question[0].Name,
+		"rcode": d.RcodeToString[code],
+	})
+	if code == d.RcodeServerFailure {
+		entry.Warn("query failed")
+	} else {
+		entry.Debug("query failed")
+	}
+}
+
+// sendNoData answers that the name exists but has no records of the
+// requested type.
+func (s *Server) sendNoData(w d.ResponseWriter, req *d.Msg) {
+	m := s.reply(req)
+	m.Ns = s.authority(req)
 	_ = w.WriteMsg(m)
+}
 
-	// TODO: log error? add a logger to options?
+// errorCode maps an API error to a DNS response code.
+func errorCode(err error) int {
+	if err == NotFoundError {
+		return d.RcodeNameError
+	}
+	return d.RcodeServerFailure
 }
 
 func (s *Server) DoHTTP(uri string, v interface{}) error {
+	data, err := s.doHTTP(uri)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *Server) doHTTP(uri string) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		s.metrics.apiRequests.WithLabelValues(apiResource(uri)).Observe(time.Since(start).Seconds())
+	}()
+
 	resp, err := s.client.Get(s.endpoint + uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, NotFoundError
+	default:
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// sendHTTP sends v, if any, to the API with method.
+func (s *Server) sendHTTP(method, uri string, v interface{}) error {
+	var body io.Reader
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.endpoint+uri, body)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
-	return json.NewDecoder(resp.Body).Decode(v)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return NotFoundError
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// txtStrings converts maps into RFC 6763 style "key=value" strings,
+// one per entry, sorted so answers are stable.
+func txtStrings(maps ...map[string]string) []string {
+	txt := []string{}
+	for _, m := range maps {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := k + "=" + m[k]
+			// a single character-string is limited to 255 bytes
+			if len(v) > 255 {
+				continue
+			}
+			txt = append(txt, v)
+		}
+	}
+
+	// an empty TXT record is a single empty string
+	if len(txt) == 0 {
+		txt = append(txt, "")
+	}
+	return txt
+}
+
+// remoteIP returns the address of the client, if any.
+func remoteIP(w d.ResponseWriter) net.IP {
+	if w == nil {
+		return nil
+	}
+	switch a := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
 }
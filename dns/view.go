@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/bakins/onedari/api"
+	d "github.com/miekg/dns"
+)
+
+type (
+	// view answers clients in its networks with the address from an
+	// instance metadata field rather than the instance address.
+	view struct {
+		networks []*net.IPNet
+		field    string
+	}
+
+	// zone is an additional domain, served from its own API endpoint
+	// and optionally limited to instances matching a label query.
+	zone struct {
+		domain   string
+		endpoint string
+		query    map[string]string
+	}
+)
+
+// clientView returns the first view containing the client, if any.
+func (s *Server) clientView(w d.ResponseWriter) *view {
+	ip := remoteIP(w)
+	if ip == nil {
+		return nil
+	}
+
+	for _, v := range s.views {
+		if v.contains(ip) {
+			return v
+		}
+	}
+	return nil
+}
+
+// instanceAddress returns the address of the instance for the client. The
+// first view containing the client is used. If the instance does not have
+// the view's metadata field, its address is used.
+func (s *Server) instanceAddress(w d.ResponseWriter, i *api.Instance) net.IP {
+	return s.clientView(w).instanceAddress(i)
+}
+
+// nodeAddress returns the address of the node for the client. Nodes do not
+// have metadata, so the view's field is taken from the first instance on
+// the node that has it, as in the address records of SRV answers.
+func (s *Server) nodeAddress(w d.ResponseWriter, n *api.Node) (net.IP, error) {
+	v := s.clientView(w)
+	if v == nil {
+		return n.Address, nil
+	}
+
+	instances := []*api.Instance{}
+	if err := s.get("/v0/instances", &instances); err != nil {
+		return nil, err
+	}
+	return v.nodeAddress(n, instances), nil
+}
+
+// instanceAddress returns the view's address for the instance. v may be
+// nil.
+func (v *view) instanceAddress(i *api.Instance) net.IP {
+	if v == nil {
+		return i.Address
+	}
+	if a := net.ParseIP(i.Metadata[v.field]); a != nil {
+		return a
+	}
+	return i.Address
+}
+
+// nodeAddress returns the view's address for the node from its instances.
+// v may be nil.
+func (v *view) nodeAddress(n *api.Node, instances []*api.Instance) net.IP {
+	if v == nil {
+		return n.Address
+	}
+	for _, i := range instances {
+		if i.Node != n.ID {
+			continue
+		}
+		if a := net.ParseIP(i.Metadata[v.field]); a != nil {
+			return a
+		}
+	}
+	return n.Address
+}
+
+func (v *view) contains(ip net.IP) bool {
+	for _, n := range v.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bakins/onedari/api"
+	d "github.com/miekg/dns"
+)
+
+// transferChunk is the number of records in each zone transfer message.
+const transferChunk = 100
+
+// addressRR returns an A or AAAA record for ip.
+func (s *Server) addressRR(name string, ip net.IP) d.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &d.A{
+			Hdr: d.RR_Header{Name: name, Rrtype: d.TypeA, Class: d.ClassINET, Ttl: s.ttl},
+			A:   ip4,
+		}
+	}
+	return &d.AAAA{
+		Hdr:  d.RR_Header{Name: name, Rrtype: d.TypeAAAA, Class: d.ClassINET, Ttl: s.ttl},
+		AAAA: ip,
+	}
+}
+
+func (s *Server) nodeName(id string) string {
+	return strings.ToLower(strings.Join([]string{id, "nodes", s.domain}, "."))
+}
+
+// Zone synthesizes the full zone from the API for the client. The SOA is
+// first and the serial is the current registry index. Addresses are from
+// the client's view.
+func (s *Server) Zone(w d.ResponseWriter) ([]d.RR, error) {
+	index := &api.Index{}
+	if err := s.DoHTTP("/v0/index", index); err != nil {
+		return nil, err
+	}
+
+	nodes := []*api.Node{}
+	if err := s.getList("/v0/nodes", &nodes); err != nil {
+		return nil, err
+	}
+
+	services := []*api.Service{}
+	if err := s.getList("/v0/services", &services); err != nil {
+		return nil, err
+	}
+
+	instances := []*api.Instance{}
+	if err := s.getList("/v0/instances", &instances); err != nil {
+		return nil, err
+	}
+
+	clientView := s.clientView(w)
+
+	soa := s.soa().(*d.SOA)
+	soa.Serial = uint32(index.Index)
+
+	records := []d.RR{soa}
+	records = append(records, s.ns()...)
+	records = append(records, s.glue()...)
+
+	for _, n := range nodes {
+		if n.Address == nil || n.ID == "" {
+			continue
+		}
+		// queries only answer A
+		address := clientView.nodeAddress(n, instances).To4()
+		if address == nil {
+			continue
+		}
+		records = append(records, s.addressRR(s.nodeName(n.ID), address))
+	}
+
+	for _, i := range instances {
+		if !api.LabelMatches(i.Labels, s.filter) {
+			continue
+		}
+		name := strings.ToLower(strings.Join([]string{i.ID, "instances", s.domain}, "."))
+		records = append(records, &d.TXT{
+			Hdr: d.RR_Header{Name: name, Rrtype: d.TypeTXT, Class: d.ClassINET, Ttl: s.ttl},
+			Txt: txtStrings(i.Labels, i.Metadata),
+		})
+	}
+
+	for _, v := range services {
+		// the summary does not include instances
+		service := &api.Service{}
+		if err := s.DoHTTP("/v0/services/"+v.ID, service); err != nil {
+			// deleted since it was listed
+			if err == NotFoundError {
+				continue
+			}
+			return nil, err
+		}
+
+		name := strings.ToLower(strings.Join([]string{service.ID, "services", s.domain}, "."))
+
+		records = append(records, &d.TXT{
+			Hdr: d.RR_Header{Name: name, Rrtype: d.TypeTXT, Class: d.ClassINET, Ttl: s.ttl},
+			Txt: txtStrings(service.Labels),
+		})
+
+		for _, i := range s.instances(service) {
+			address := clientView.instanceAddress(i)
+			if address == nil {
+				continue
+			}
+			if ip4 := address.To4(); ip4 != nil {
+				records = append(records, s.addressRR(name, ip4))
+			}
+
+			if i.Node == "" {
+				continue
+			}
+			records = append(records, &d.SRV{
+				Hdr:      d.RR_Header{Name: name, Rrtype: d.TypeSRV, Class: d.ClassINET, Ttl: s.ttl},
+				Port:     i.Port,
+				Target:   s.nodeName(i.Node),
+				Weight:   i.MetadataInt("weight"),
+				Priority: i.MetadataInt("priority"),
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// getList gets a list from the API. A missing list is empty.
+func (s *Server) getList(uri string, v interface{}) error {
+	if err := s.DoHTTP(uri, v); err != nil && err != NotFoundError {
+		return err
+	}
+	return nil
+}
+
+// allowTransfer returns true if the client may transfer the zone.
+func (s *Server) allowTransfer(w d.ResponseWriter) bool {
+	ip := remoteIP(w)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range s.transferACL {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Transfer answers AXFR and IXFR queries with the full zone. IXFR is
+// answered with the full zone as well, as allowed by RFC 1995.
+func (s *Server) Transfer(w d.ResponseWriter, r *d.Msg) {
+	if !s.allowTransfer(w) {
+		s.sendError(w, r, fmt.Errorf("transfer not allowed: %s", w.RemoteAddr()), d.RcodeRefused)
+		return
+	}
+
+	// transfers are tcp only
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		s.sendError(w, r, fmt.Errorf("transfer over udp: %s", w.RemoteAddr()), d.RcodeRefused)
+		return
+	}
+
+	records, err := s.Zone(w)
+	if err != nil {
+		s.sendError(w, r, err, d.RcodeServerFailure)
+		return
+	}
+	// the zone ends with the SOA as well
+	records = append(records, records[0])
+
+	ch := make(chan *d.Envelope)
+	tr := &d.Transfer{}
+
+	// Out returns early if a write fails, such as when the client goes
+	// away, so stop sending when it does.
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.Out(w, r, ch)
+	}()
+
+SEND:
+	for len(records) > 0 {
+		n := transferChunk
+		if n > len(records) {
+			n = len(records)
+		}
+		select {
+		case ch <- &d.Envelope{RR: records[:n]}:
+			records = records[n:]
+		case err = <-done:
+			break SEND
+		}
+	}
+	close(ch)
+
+	if len(records) == 0 {
+		err = <-done
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("client", w.RemoteAddr()).Warn("transfer failed")
+	}
+
+	_ = w.Close()
+}
+
+// sendNotifies sends a NOTIFY to secondaries when the registry changes,
+// at most once a second. It does not return.
+func (s *Server) sendNotifies() {
+	c := &d.Client{
+		Net:     "udp",
+		Timeout: 5 * time.Second, // configurable??
+	}
+
+	for range s.notifyPending {
+		m := &d.Msg{}
+		m.SetNotify(s.domain)
+		m.Answer = []d.RR{s.soa()}
+
+		for _, addr := range s.notify {
+			// secondaries will retry on their refresh interval.
+			_, _, _ = c.Exchange(m, addr)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,172 @@
+package dns
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	d "github.com/miekg/dns"
+)
+
+// transfer runs an AXFR of the domain against s over TCP.
+func transfer(t *testing.T, s *Server) ([]d.RR, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &d.Server{Listener: l, Handler: s}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	m := &d.Msg{}
+	m.SetAxfr(s.domain)
+
+	env, err := (&d.Transfer{}).In(m, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []d.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		records = append(records, e.RR...)
+	}
+	return records, nil
+}
+
+func TestTransferEmpty(t *testing.T) {
+	tests := []struct {
+		desc   string
+		status int
+	}{
+		{"empty lists", http.StatusOK},
+		{"missing lists", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v0/index" {
+				_, _ = w.Write([]byte(`{"index":7}`))
+				return
+			}
+			w.WriteHeader(tt.status)
+			_, _ = w.Write([]byte(`[]`))
+		}))
+		defer ts.Close()
+
+		s, err := New(Endpoint(ts.URL), TransferACL([]string{"127.0.0.1"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := transfer(t, s)
+		if err != nil {
+			t.Errorf("%s: transfer failed: %s", tt.desc, err)
+			continue
+		}
+
+		if len(records) < 2 {
+			t.Fatalf("%s: expected at least the SOA twice, got %v", tt.desc, records)
+		}
+		first, ok := records[0].(*d.SOA)
+		if !ok || first.Serial != 7 {
+			t.Errorf("%s: expected SOA with serial 7 first, got %s", tt.desc, records[0])
+		}
+		if _, ok := records[len(records)-1].(*d.SOA); !ok {
+			t.Errorf("%s: expected SOA last, got %s", tt.desc, records[len(records)-1])
+		}
+		// only the nameservers and their glue
+		for _, rr := range records[1 : len(records)-1] {
+			switch rr.(type) {
+			case *d.NS, *d.A, *d.AAAA:
+			default:
+				t.Errorf("%s: unexpected record in an empty zone: %s", tt.desc, rr)
+			}
+		}
+	}
+}
+
+func TestTransferSkipsDeletedServices(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/index":
+			_, _ = w.Write([]byte(`{"index":7}`))
+		case "/v0/services":
+			_, _ = w.Write([]byte(`[{"id":"gone"},{"id":"web"}]`))
+		case "/v0/services/web":
+			_, _ = w.Write([]byte(`{"id":"web","instances":[
+				{"id":"web1","node":"n1","ip":"10.0.0.1","port":80,"up":true},
+				{"id":"web2","node":"n1","ip":"2001:db8::1","port":80,"up":true}
+			]}`))
+		case "/v0/nodes", "/v0/instances":
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	s, err := New(Endpoint(ts.URL), TransferACL([]string{"127.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := transfer(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a, srv int
+	for _, rr := range records {
+		if rr.Header().Name != "web.services."+s.domain {
+			continue
+		}
+		switch rr.(type) {
+		case *d.A:
+			a++
+		case *d.AAAA:
+			t.Errorf("zone includes an address queries do not answer: %s", rr)
+		case *d.SRV:
+			srv++
+		}
+	}
+	if a != 1 || srv != 2 {
+		t.Errorf("expected 1 A and 2 SRV records for web, got %d and %d", a, srv)
+	}
+}
+
+func TestTransferDoH(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected API request: %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	// the client is allowed to transfer over TCP.
+	s, err := New(Endpoint(ts.URL), TransferACL([]string{"192.0.2.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &d.Msg{}
+	m.SetAxfr(s.domain)
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	reply := &d.Msg{}
+	if err := reply.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	if reply.Rcode != d.RcodeRefused {
+		t.Errorf("expected REFUSED, got %s", d.RcodeToString[reply.Rcode])
+	}
+}
@@ -0,0 +1,428 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultSocket is the default path of the Docker Engine API socket.
+	DefaultSocket = "/var/run/docker.sock"
+	// DefaultInterval is the default interval at which running containers
+	// are announced again.
+	DefaultInterval = 60 * time.Second
+
+	// Container labels.
+	AppLabel      = "onedari.app"
+	PortLabel     = "onedari.port" // container port to announce when more than one is published
+	LabelPrefix   = "onedari.label."
+	MetadataLabel = "onedari.metadata."
+
+	// containerMetadata marks instances registered for a container.
+	containerMetadata = "container"
+)
+
+type (
+	// Announcer registers Docker containers as instances on the local
+	// node and removes them when they stop.
+	Announcer struct {
+		socket   string
+		interval time.Duration
+		client   *client.Client
+		node     *api.Node
+		docker   *http.Client
+	}
+
+	OptionFunc func(*Announcer) error
+
+	// container is the subset of a container inspect response we use.
+	container struct {
+		ID     string `json:"Id"`
+		Name   string `json:"Name"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		State struct {
+			Running bool `json:"Running"`
+		} `json:"State"`
+		NetworkSettings struct {
+			Ports map[string][]binding `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+
+	// binding is a host address and port a container port is published on.
+	binding struct {
+		HostIP   string `json:"HostIp"`
+		HostPort string `json:"HostPort"`
+	}
+
+	// event is the subset of a Docker event we use.
+	event struct {
+		Type   string `json:"Type"`
+		Action string `json:"Action"`
+		Actor  struct {
+			ID string `json:"ID"`
+		} `json:"Actor"`
+	}
+)
+
+// Socket sets the path of the Docker Engine API socket.
+func Socket(path string) OptionFunc {
+	return func(a *Announcer) error {
+		a.socket = path
+		return nil
+	}
+}
+
+// Interval sets how often running containers are announced again.
+func Interval(interval time.Duration) OptionFunc {
+	return func(a *Announcer) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid interval: %s", interval)
+		}
+		a.interval = interval
+		return nil
+	}
+}
+
+// Client sets the API client.
+func Client(c *client.Client) OptionFunc {
+	return func(a *Announcer) error {
+		a.client = c
+		return nil
+	}
+}
+
+// Node sets the local node. Default is the API server's node.
+func Node(n *api.Node) OptionFunc {
+	return func(a *Announcer) error {
+		a.node = n
+		return nil
+	}
+}
+
+// New creates a new Announcer.
+func New(options ...OptionFunc) (*Announcer, error) {
+	a := &Announcer{
+		socket:   DefaultSocket,
+		interval: DefaultInterval,
+	}
+
+	for _, option := range options {
+		if err := option(a); err != nil {
+			f := runtime.FuncForPC(reflect.ValueOf(option).Pointer()).Name()
+			return nil, fmt.Errorf("failure in function %s: %s", f, err)
+		}
+	}
+
+	if a.client == nil {
+		var err error
+		a.client, err = client.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	socket := a.socket
+	a.docker = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	return a, nil
+}
+
+// Run announces containers, reconnecting to the events stream whenever it
+// fails. It only returns if the local node cannot be found.
+func (a *Announcer) Run() error {
+	if a.node == nil {
+		n, err := a.client.LocalNode(context.Background())
+		if err != nil {
+			return err
+		}
+		a.node = n
+	}
+
+	go func() {
+		for range time.Tick(a.interval) {
+			if err := a.Sync(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	for {
+		// start watching before syncing so nothing is missed.
+		resp, err := a.events()
+		if err != nil {
+			log.Error(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err := a.Sync(); err != nil {
+			log.Error(err)
+		}
+
+		err = a.handleEvents(resp)
+		log.Error(err)
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Sync registers all running containers and removes instances of
+// containers that are gone.
+func (a *Announcer) Sync() error {
+	var ids []struct {
+		ID string `json:"Id"`
+	}
+	filters := `{"label":["` + AppLabel + `"]}`
+	if err := a.get("/containers/json?filters="+url.QueryEscape(filters), &ids); err != nil {
+		return err
+	}
+
+	running := make(map[string]bool, len(ids))
+	for _, c := range ids {
+		running[c.ID] = true
+		if err := a.register(c.ID); err != nil {
+			log.Error(err)
+		}
+	}
+
+	instances, err := a.client.Instances(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range instances {
+		id, ok := i.Metadata[containerMetadata]
+		if !ok || i.Node != a.node.ID || running[id] {
+			continue
+		}
+		if err := a.client.DeleteInstance(context.Background(), i.ID); err != nil && !client.IsNotFound(err) {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Announcer) events() (*http.Response, error) {
+	filters := `{"type":["container"],"event":["start","die"],"label":["` + AppLabel + `"]}`
+
+	resp, err := a.docker.Get("http://docker/events?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// handleEvents reads the events stream until it fails.
+func (a *Announcer) handleEvents(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		e := &event{}
+		if err := dec.Decode(e); err != nil {
+			return err
+		}
+
+		var err error
+		switch e.Action {
+		case "start":
+			err = a.register(e.Actor.ID)
+		case "die":
+			err = a.deregister(e.Actor.ID)
+		}
+
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// register announces a running container.
+func (a *Announcer) register(id string) error {
+	c := &container{}
+	if err := a.get("/containers/"+id+"/json", c); err != nil {
+		return err
+	}
+
+	if !c.State.Running {
+		return nil
+	}
+
+	i, err := a.instance(c)
+	if err != nil {
+		return err
+	}
+	if i == nil {
+		return nil
+	}
+
+	_, err = a.client.PutInstance(context.Background(), i)
+	return err
+}
+
+// deregister removes the instance of a container. The container may be
+// gone, so the name is not known and the instance is found by metadata.
+func (a *Announcer) deregister(id string) error {
+	instances, err := a.client.Instances(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range instances {
+		if i.Node != a.node.ID || i.Metadata[containerMetadata] != id {
+			continue
+		}
+		if err := a.client.DeleteInstance(context.Background(), i.ID); err != nil && !client.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// instance returns the instance for a container, or nil if it is not to be
+// announced.
+func (a *Announcer) instance(c *container) (*api.Instance, error) {
+	labels := c.Config.Labels
+	app := labels[AppLabel]
+	if app == "" {
+		return nil, nil
+	}
+
+	name := strings.TrimPrefix(c.Name, "/")
+
+	i := api.NewInstance()
+	i.ID = a.node.ID + "-" + name
+	i.Node = a.node.ID
+	i.Address = a.node.Address
+	i.Up = true
+	i.Labels["app"] = app
+	i.Metadata[containerMetadata] = c.ID
+
+	for k, v := range labels {
+		switch {
+		case strings.HasPrefix(k, LabelPrefix):
+			i.Labels[strings.TrimPrefix(k, LabelPrefix)] = v
+		case strings.HasPrefix(k, MetadataLabel):
+			i.Metadata[strings.TrimPrefix(k, MetadataLabel)] = v
+		}
+	}
+
+	ip, port, err := publishedPort(c, labels[PortLabel])
+	if err != nil {
+		return nil, fmt.Errorf("container %s: %s", name, err)
+	}
+	i.Port = port
+	if ip != nil {
+		i.Address = ip
+	}
+
+	return i, nil
+}
+
+// publishedPort returns the host address and port of the container port,
+// or of the lowest published port if none is given. The address is nil if
+// the port is bound to all addresses, so the node address is used. Ports
+// bound only to loopback cannot be reached from other nodes and are
+// skipped.
+func publishedPort(c *container, want string) (net.IP, uint16, error) {
+	ports := make([]string, 0, len(c.NetworkSettings.Ports))
+	for p, bindings := range c.NetworkSettings.Ports {
+		if _, ok := reachable(bindings); ok {
+			ports = append(ports, p)
+		}
+	}
+
+	if len(ports) == 0 {
+		// announced without a port, like announce does.
+		return nil, 0, nil
+	}
+
+	var port string
+	if want != "" {
+		for _, p := range ports {
+			if p == want || strings.SplitN(p, "/", 2)[0] == want {
+				port = p
+			}
+		}
+		if port == "" {
+			return nil, 0, fmt.Errorf("port %s is not published", want)
+		}
+	} else {
+		// numerically, so 80/tcp is before 443/tcp
+		sort.Slice(ports, func(x, y int) bool {
+			return portNumber(ports[x]) < portNumber(ports[y])
+		})
+		port = ports[0]
+	}
+
+	b, _ := reachable(c.NetworkSettings.Ports[port])
+	p, err := strconv.ParseUint(b.HostPort, 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := net.ParseIP(b.HostIP)
+	if ip != nil && ip.IsUnspecified() {
+		ip = nil
+	}
+	return ip, uint16(p), nil
+}
+
+// reachable returns the first binding that other nodes can reach.
+func reachable(bindings []binding) (binding, bool) {
+	for _, b := range bindings {
+		if ip := net.ParseIP(b.HostIP); ip != nil && ip.IsLoopback() {
+			continue
+		}
+		return b, true
+	}
+	return binding{}, false
+}
+
+func portNumber(p string) int {
+	n, _ := strconv.Atoi(strings.SplitN(p, "/", 2)[0])
+	return n
+}
+
+func (a *Announcer) get(path string, v interface{}) error {
+	resp, err := a.docker.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from docker: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,287 @@
+package docker
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+)
+
+// fakeDocker serves the parts of the Docker Engine API the announcer uses
+// on a unix socket.
+func fakeDocker(t *testing.T, events []string, containers map[string]string) string {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Query().Get("filters"), AppLabel) {
+			t.Errorf("events not filtered by label: %s", r.URL.RawQuery)
+		}
+		// the stream ends after these, as when docker restarts.
+		for _, e := range events {
+			_, _ = io.WriteString(w, e+"\n")
+		}
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		ids := []string{}
+		for id := range containers {
+			ids = append(ids, `{"Id":"`+id+`"}`)
+		}
+		sort.Strings(ids)
+		_, _ = io.WriteString(w, "["+strings.Join(ids, ",")+"]")
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		c, ok := containers[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, c)
+	})
+
+	ts := &httptest.Server{Listener: l, Config: &http.Server{Handler: mux}}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return socket
+}
+
+// fakeAPI is a onedari API that records instance changes.
+type fakeAPI struct {
+	sync.Mutex
+	instances []*api.Instance
+	put       map[string]*api.Instance
+	deleted   []string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, "/v0/instances/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v0/instances":
+		_ = json.NewEncoder(w).Encode(f.instances)
+	case r.Method == "PUT":
+		i := api.NewInstance()
+		if err := json.NewDecoder(r.Body).Decode(i); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.put[id] = i
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(i)
+	case r.Method == "DELETE":
+		f.deleted = append(f.deleted, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newAnnouncer(t *testing.T, socket string, f *fakeAPI) *Announcer {
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	c, err := client.New(client.Endpoints([]string{ts.URL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(
+		Socket(socket),
+		Client(c),
+		Node(&api.Node{ID: "node1", Address: net.ParseIP("10.0.0.1")}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+const webContainer = `{
+	"Id": "c1",
+	"Name": "/web",
+	"Config": {"Labels": {"onedari.app": "web", "onedari.label.env": "prod", "onedari.metadata.weight": "5"}},
+	"State": {"Running": true},
+	"NetworkSettings": {"Ports": {
+		"80/tcp": [{"HostIp": "0.0.0.0", "HostPort": "32768"}],
+		"443/tcp": [{"HostIp": "127.0.0.1", "HostPort": "32769"}]
+	}}
+}`
+
+func TestEvents(t *testing.T) {
+	socket := fakeDocker(t,
+		[]string{
+			`{"Type":"container","Action":"start","Actor":{"ID":"c1"}}`,
+			`{"Type":"container","Action":"die","Actor":{"ID":"c2"}}`,
+		},
+		map[string]string{"c1": webContainer},
+	)
+
+	f := &fakeAPI{
+		put: make(map[string]*api.Instance),
+		instances: []*api.Instance{
+			{ID: "node1-old", Node: "node1", Metadata: map[string]string{containerMetadata: "c2"}},
+			{ID: "node2-old", Node: "node2", Metadata: map[string]string{containerMetadata: "c2"}},
+		},
+	}
+	a := newAnnouncer(t, socket, f)
+
+	resp, err := a.events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.handleEvents(resp); err != io.EOF {
+		t.Fatalf("expected the stream to end, got %v", err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	i, ok := f.put["node1-web"]
+	if !ok {
+		t.Fatalf("container was not registered: %v", f.put)
+	}
+	if i.Node != "node1" || !i.Address.Equal(net.ParseIP("10.0.0.1")) || i.Port != 32768 || !i.Up {
+		t.Errorf("unexpected instance: %+v", i)
+	}
+	if i.Labels["app"] != "web" || i.Labels["env"] != "prod" {
+		t.Errorf("unexpected labels: %v", i.Labels)
+	}
+	if i.Metadata["weight"] != "5" || i.Metadata[containerMetadata] != "c1" {
+		t.Errorf("unexpected metadata: %v", i.Metadata)
+	}
+
+	if len(f.deleted) != 1 || f.deleted[0] != "node1-old" {
+		t.Errorf("expected only the instance on this node to be deregistered, got %v", f.deleted)
+	}
+}
+
+func TestSync(t *testing.T) {
+	socket := fakeDocker(t, nil, map[string]string{"c1": webContainer})
+
+	f := &fakeAPI{
+		put: make(map[string]*api.Instance),
+		instances: []*api.Instance{
+			{ID: "node1-web", Node: "node1", Metadata: map[string]string{containerMetadata: "c1"}},
+			{ID: "node1-gone", Node: "node1", Metadata: map[string]string{containerMetadata: "c3"}},
+			{ID: "node1-manual", Node: "node1"},
+			{ID: "node2-gone", Node: "node2", Metadata: map[string]string{containerMetadata: "c4"}},
+		},
+	}
+	a := newAnnouncer(t, socket, f)
+
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.put["node1-web"]; !ok {
+		t.Errorf("running container was not registered: %v", f.put)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != "node1-gone" {
+		t.Errorf("expected only the stopped container to be removed, got %v", f.deleted)
+	}
+}
+
+func TestPublishedPort(t *testing.T) {
+	tests := []struct {
+		desc  string
+		ports map[string][]binding
+		want  string
+		ip    string
+		port  uint16
+		err   bool
+	}{
+		{"none", nil, "", "", 0, false},
+		{
+			"lowest",
+			map[string][]binding{
+				"443/tcp": {{HostIP: "0.0.0.0", HostPort: "32769"}},
+				"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "32768"}},
+			},
+			"", "", 32768, false,
+		},
+		{
+			"label",
+			map[string][]binding{
+				"443/tcp": {{HostIP: "0.0.0.0", HostPort: "32769"}},
+				"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "32768"}},
+			},
+			"443", "", 32769, false,
+		},
+		{
+			"loopback skipped",
+			map[string][]binding{
+				"80/tcp":   {{HostIP: "127.0.0.1", HostPort: "32768"}},
+				"8080/tcp": {{HostIP: "::", HostPort: "32770"}},
+			},
+			"", "", 32770, false,
+		},
+		{
+			"loopback only",
+			map[string][]binding{
+				"80/tcp": {{HostIP: "127.0.0.1", HostPort: "32768"}, {HostIP: "::1", HostPort: "32768"}},
+			},
+			"", "", 0, false,
+		},
+		{
+			"specific address",
+			map[string][]binding{
+				"80/tcp": {{HostIP: "127.0.0.1", HostPort: "32768"}, {HostIP: "192.168.1.5", HostPort: "32771"}},
+			},
+			"", "192.168.1.5", 32771, false,
+		},
+		{
+			"not published",
+			map[string][]binding{
+				"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "32768"}},
+				"443/tcp": nil,
+			},
+			"443", "", 0, true,
+		},
+	}
+
+	for _, tt := range tests {
+		c := &container{}
+		c.NetworkSettings.Ports = tt.ports
+
+		ip, port, err := publishedPort(c, tt.want)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+
+		if port != tt.port {
+			t.Errorf("%s: expected port %d, got %d", tt.desc, tt.port, port)
+		}
+		switch {
+		case tt.ip == "" && ip != nil:
+			t.Errorf("%s: expected the node address, got %s", tt.desc, ip)
+		case tt.ip != "" && !ip.Equal(net.ParseIP(tt.ip)):
+			t.Errorf("%s: expected %s, got %s", tt.desc, tt.ip, ip)
+		}
+	}
+}
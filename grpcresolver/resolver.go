@@ -0,0 +1,226 @@
+package grpcresolver
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// Scheme is the gRPC target scheme, as in onedari:///service?track=prod
+	Scheme = "onedari"
+	// DefaultInterval is the default polling interval, in case watches fail.
+	DefaultInterval = 30 * time.Second
+)
+
+type (
+	// Builder builds resolvers for onedari:/// targets.
+	Builder struct {
+		client   *client.Client
+		interval time.Duration
+	}
+
+	OptionFunc func(*Builder) error
+
+	onedariResolver struct {
+		builder *Builder
+		service string
+		labels  map[string]string
+		cc      resolver.ClientConn
+		ctx     context.Context
+		cancel  context.CancelFunc
+		refresh chan struct{}
+	}
+
+	attributeKey string
+)
+
+const (
+	weightKey   = attributeKey("weight")
+	priorityKey = attributeKey("priority")
+)
+
+// Client sets the API client.
+func Client(c *client.Client) OptionFunc {
+	return func(b *Builder) error {
+		b.client = c
+		return nil
+	}
+}
+
+// Interval sets how often to poll the API, in addition to watching it.
+func Interval(interval time.Duration) OptionFunc {
+	return func(b *Builder) error {
+		if interval <= 0 {
+			return fmt.Errorf("interval must be positive")
+		}
+		b.interval = interval
+		return nil
+	}
+}
+
+// New creates a new Builder. Use it with grpc.WithResolvers or Register.
+func New(options ...OptionFunc) (*Builder, error) {
+	b := &Builder{
+		interval: DefaultInterval,
+	}
+
+	for _, option := range options {
+		if err := option(b); err != nil {
+			f := runtime.FuncForPC(reflect.ValueOf(option).Pointer()).Name()
+			return nil, fmt.Errorf("failure in function %s: %s", f, err)
+		}
+	}
+
+	if b.client == nil {
+		var err error
+		b.client, err = client.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Register registers the builder globally for the onedari scheme.
+func Register(b *Builder) {
+	resolver.Register(b)
+}
+
+// Weight returns the weight metadata of an address.
+func Weight(a resolver.Address) uint32 {
+	v, _ := a.BalancerAttributes.Value(weightKey).(uint32)
+	return v
+}
+
+// Priority returns the priority metadata of an address.
+func Priority(a resolver.Address) uint32 {
+	v, _ := a.BalancerAttributes.Value(priorityKey).(uint32)
+	return v
+}
+
+// Scheme implements resolver.Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build implements resolver.Builder. The path of the target is the service
+// and the query string is labels the instances must match.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	service := strings.TrimPrefix(target.URL.Path, "/")
+	if service == "" {
+		service = target.URL.Opaque
+	}
+	if service == "" {
+		return nil, fmt.Errorf("missing service in target: %s", target.URL.String())
+	}
+
+	labels := make(map[string]string)
+	for k, v := range target.URL.Query() {
+		labels[k] = v[0]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &onedariResolver{
+		builder: b,
+		service: service,
+		labels:  labels,
+		cc:      cc,
+		ctx:     ctx,
+		cancel:  cancel,
+		refresh: make(chan struct{}, 1),
+	}
+
+	go r.watch()
+	go r.run()
+
+	return r, nil
+}
+
+// ResolveNow implements resolver.Resolver.
+func (r *onedariResolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.trigger()
+}
+
+// Close implements resolver.Resolver.
+func (r *onedariResolver) Close() {
+	r.cancel()
+}
+
+// trigger asks for a refresh without blocking.
+func (r *onedariResolver) trigger() {
+	select {
+	case r.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// run resolves when triggered and on the polling interval.
+func (r *onedariResolver) run() {
+	ticker := time.NewTicker(r.builder.interval)
+	defer ticker.Stop()
+
+	r.resolve()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.refresh:
+		}
+		r.resolve()
+	}
+}
+
+// watch triggers a refresh on every change to the registry. Polling covers
+// any time the watch is failing.
+func (r *onedariResolver) watch() {
+	for {
+		_ = r.builder.client.Watch(r.ctx, func(*api.Event) error {
+			r.trigger()
+			return nil
+		})
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(r.builder.interval):
+		}
+	}
+}
+
+func (r *onedariResolver) resolve() {
+	v, err := r.builder.client.Service(r.ctx, r.service)
+	if err != nil {
+		if r.ctx.Err() == nil {
+			r.cc.ReportError(err)
+		}
+		return
+	}
+
+	addrs := make([]resolver.Address, 0, len(v.Instances))
+	for _, i := range v.Instances {
+		if i.Address == nil || i.Port == 0 || !api.LabelMatches(i.Labels, r.labels) {
+			continue
+		}
+
+		addrs = append(addrs, resolver.Address{
+			Addr: net.JoinHostPort(i.Address.String(), strconv.Itoa(int(i.Port))),
+			BalancerAttributes: attributes.New(weightKey, uint32(i.MetadataInt("weight"))).
+				WithValue(priorityKey, uint32(i.MetadataInt("priority"))),
+		})
+	}
+
+	_ = r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/client"
+	"github.com/bakins/onedari/transport"
+)
+
+const (
+	// DefaultAddress is the default listen address for the proxy.
+	DefaultAddress = "127.0.0.1:8080"
+	// DefaultDomain is the default domain of service host names.
+	DefaultDomain = "onedari.local."
+	// DefaultPrefix is the default path prefix for routing by path, as in
+	// /services/<service>/
+	DefaultPrefix = "/services/"
+	// DefaultRetries is the default number of instances tried when
+	// connecting fails.
+	DefaultRetries = 2
+	// DefaultOutlier is the default number of consecutive 5xx responses
+	// before an instance is ejected.
+	DefaultOutlier = 5
+	// DefaultMaxIdleConns is the default number of idle connections kept
+	// per instance.
+	DefaultMaxIdleConns = 16
+
+	// requests are handed to the transport as http://<service>.service/
+	serviceSuffix = transport.DefaultSuffix
+)
+
+type (
+	// Proxy is an HTTP reverse proxy that sends requests for
+	// <service>.services.<domain> or /services/<service>/ to a healthy
+	// instance of the service.
+	Proxy struct {
+		address      string
+		domain       string
+		prefix       string
+		client       *client.Client
+		retries      int
+		outlier      int
+		ejection     time.Duration
+		maxIdleConns int
+		proxy        *httputil.ReverseProxy
+	}
+
+	OptionFunc func(*Proxy) error
+)
+
+// Address sets the listen address.
+func Address(addr string) OptionFunc {
+	return func(p *Proxy) error {
+		p.address = addr
+		return nil
+	}
+}
+
+// Domain sets the domain of service host names.
+func Domain(domain string) OptionFunc {
+	return func(p *Proxy) error {
+		p.domain = domain
+		return nil
+	}
+}
+
+// Prefix sets the path prefix for routing by path. An empty prefix
+// disables it.
+func Prefix(prefix string) OptionFunc {
+	return func(p *Proxy) error {
+		if prefix != "" && (!strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/")) {
+			return fmt.Errorf("prefix must begin and end with /: %s", prefix)
+		}
+		p.prefix = prefix
+		return nil
+	}
+}
+
+// Client sets the API client.
+func Client(c *client.Client) OptionFunc {
+	return func(p *Proxy) error {
+		p.client = c
+		return nil
+	}
+}
+
+// Retries sets how many other instances are tried when connecting fails.
+func Retries(retries int) OptionFunc {
+	return func(p *Proxy) error {
+		p.retries = retries
+		return nil
+	}
+}
+
+// Outlier sets how many consecutive 5xx responses eject an instance.
+func Outlier(failures int) OptionFunc {
+	return func(p *Proxy) error {
+		p.outlier = failures
+		return nil
+	}
+}
+
+// Ejection sets how long an instance is skipped once ejected.
+func Ejection(ejection time.Duration) OptionFunc {
+	return func(p *Proxy) error {
+		p.ejection = ejection
+		return nil
+	}
+}
+
+// MaxIdleConns sets the number of idle connections kept per instance.
+func MaxIdleConns(n int) OptionFunc {
+	return func(p *Proxy) error {
+		p.maxIdleConns = n
+		return nil
+	}
+}
+
+// New creates a new Proxy.
+func New(options ...OptionFunc) (*Proxy, error) {
+	p := &Proxy{
+		address:      DefaultAddress,
+		domain:       DefaultDomain,
+		prefix:       DefaultPrefix,
+		retries:      DefaultRetries,
+		outlier:      DefaultOutlier,
+		ejection:     transport.DefaultEjection,
+		maxIdleConns: DefaultMaxIdleConns,
+	}
+
+	for _, option := range options {
+		if err := option(p); err != nil {
+			f := runtime.FuncForPC(reflect.ValueOf(option).Pointer()).Name()
+			return nil, fmt.Errorf("failure in function %s: %s", f, err)
+		}
+	}
+
+	p.domain = strings.ToLower(strings.Trim(p.domain, "."))
+
+	if p.client == nil {
+		var err error
+		p.client, err = client.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// connections are pooled per instance.
+	next := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost:   p.maxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	t, err := transport.New(
+		transport.Client(p.client),
+		transport.Next(next),
+		transport.Suffix(serviceSuffix),
+		transport.Retries(p.retries),
+		transport.Outlier(p.outlier),
+		transport.Ejection(p.ejection),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p.proxy = &httputil.ReverseProxy{
+		// the handler rewrites the request before it gets here.
+		Director:     func(*http.Request) {},
+		Transport:    t,
+		ErrorHandler: p.errorHandler,
+	}
+
+	return p, nil
+}
+
+// Run starts the proxy.  It does not return, generally.
+func (p *Proxy) Run() error {
+	return http.ListenAndServe(p.address, p)
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, path := p.route(r)
+	if name == "" {
+		http.Error(w, "unknown service", http.StatusNotFound)
+		return
+	}
+
+	r.URL.Scheme = "http"
+	r.URL.Host = name + serviceSuffix
+	r.URL.Path = path
+	r.URL.RawPath = ""
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// route returns the service and path of the request, by host name first
+// and then by path prefix.
+func (p *Proxy) route(r *http.Request) (string, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	suffix := ".services." + p.domain
+	if strings.HasSuffix(host, suffix) {
+		name := strings.TrimSuffix(host, suffix)
+		if validName(name) {
+			return name, r.URL.Path
+		}
+		return "", ""
+	}
+
+	if p.prefix == "" || !strings.HasPrefix(r.URL.Path, p.prefix) {
+		return "", ""
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, p.prefix)
+	parts := strings.SplitN(rest, "/", 2)
+	if !validName(parts[0]) {
+		return "", ""
+	}
+
+	path := "/"
+	if len(parts) == 2 {
+		path += parts[1]
+	}
+	return strings.ToLower(parts[0]), path
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusBadGateway
+	if client.IsNotFound(err) {
+		code = http.StatusNotFound
+	}
+
+	log.WithError(err).WithField("host", r.URL.Host).Warn("proxy request failed")
+	w.WriteHeader(code)
+}
+
+// validName returns true if name is a single DNS label.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "./")
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/bakins/onedari/api"
+	"github.com/julienschmidt/httprouter"
+)
+
+// AddressSelector returns true if the instance has the given address.
+func AddressSelector(ip net.IP) InstanceSelectorFunc {
+	return func(i *api.Instance) bool {
+		return ip.Equal(i.Address)
+	}
+}
+
+// NodeAddressSelector returns true if the node has the given address.
+func NodeAddressSelector(ip net.IP) NodeSelectorFunc {
+	return func(n *api.Node) bool {
+		return ip.Equal(n.Address)
+	}
+}
+
+// NodesByAddress returns the nodes that have the given address, either
+// directly or via one of their instances. An empty registry has none.
+func (s *Server) NodesByAddress(ip net.IP) ([]*api.Node, error) {
+	instances, err := s.ListInstances(AddressSelector(ip))
+	if err != nil && !isEmpty(err) {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(instances))
+	for _, i := range instances {
+		if i.Node != "" {
+			ids[i.Node] = true
+		}
+	}
+
+	nodes, err := s.ListNodes(func(n *api.Node) bool {
+		return ids[n.ID] || NodeAddressSelector(ip)(n)
+	})
+	if err != nil && !isEmpty(err) {
+		return nil, err
+	}
+	if nodes == nil {
+		nodes = []*api.Node{}
+	}
+	return nodes, nil
+}
+
+func (s *Server) getAddress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ip := net.ParseIP(ps[0].Value)
+	if ip == nil {
+		httpError(w, http.StatusBadRequest, InvalidAddressError)
+		return
+	}
+
+	nodes, err := s.NodesByAddress(ip)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_ = JSON(w, http.StatusOK, nodes)
+}
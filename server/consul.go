@@ -0,0 +1,439 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakins/onedari/api"
+	"github.com/coreos/etcd/client"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+)
+
+// ConsulDatacenter is the datacenter reported to Consul clients.
+const ConsulDatacenter = "dc1"
+
+type (
+	// ConsulService is a service as registered with the Consul agent.
+	ConsulService struct {
+		ID      string            `json:"ID"`
+		Name    string            `json:"Name"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	}
+
+	// ConsulAgentService is a service in a health response.
+	ConsulAgentService struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	}
+
+	// ConsulNode is a node in a health response.
+	ConsulNode struct {
+		ID         string `json:"ID"`
+		Node       string `json:"Node"`
+		Address    string `json:"Address"`
+		Datacenter string `json:"Datacenter"`
+	}
+
+	// ConsulCheck is the health of an instance.
+	ConsulCheck struct {
+		Node        string `json:"Node"`
+		CheckID     string `json:"CheckID"`
+		Name        string `json:"Name"`
+		Status      string `json:"Status"`
+		ServiceID   string `json:"ServiceID"`
+		ServiceName string `json:"ServiceName"`
+	}
+
+	// ConsulServiceEntry is an entry in /v1/health/service/:name
+	ConsulServiceEntry struct {
+		Node    *ConsulNode         `json:"Node"`
+		Service *ConsulAgentService `json:"Service"`
+		Checks  []*ConsulCheck      `json:"Checks"`
+	}
+
+	// ConsulCatalogService is an entry in /v1/catalog/service/:name
+	ConsulCatalogService struct {
+		ID             string            `json:"ID"`
+		Node           string            `json:"Node"`
+		Address        string            `json:"Address"`
+		Datacenter     string            `json:"Datacenter"`
+		ServiceID      string            `json:"ServiceID"`
+		ServiceName    string            `json:"ServiceName"`
+		ServiceTags    []string          `json:"ServiceTags"`
+		ServiceAddress string            `json:"ServiceAddress"`
+		ServicePort    int               `json:"ServicePort"`
+		ServiceMeta    map[string]string `json:"ServiceMeta"`
+	}
+)
+
+// Consul enables a subset of the Consul HTTP API under /v1.
+func Consul(enabled bool) OptionFunc {
+	return func(s *Server) error {
+		s.consul = enabled
+		return nil
+	}
+}
+
+func (s *Server) consulRoutes(r *httprouter.Router) {
+	r.GET("/v1/catalog/services", s.consulCatalogServices)
+	r.GET("/v1/catalog/service/:name", s.consulCatalogService)
+	r.GET("/v1/health/service/:name", s.consulHealthService)
+	r.PUT("/v1/agent/service/register", s.consulRegister)
+	r.PUT("/v1/agent/service/deregister/:id", s.consulDeregister)
+}
+
+// consulInstances returns the instances of the onedari service with the
+// name or, if there is none, the instances with the app label. Consul
+// tags in the tag query parameter must all match.
+func (s *Server) consulInstances(r *http.Request, name string) ([]*api.Instance, error) {
+	query := map[string]string{"app": name}
+
+	v := &api.Service{}
+	err := s.etcdGet("services/"+name, v)
+	switch {
+	case err == nil:
+		query = v.Query
+	case !isKeyNotFound(err):
+		return nil, err
+	}
+
+	tags := tagsToLabels(r.URL.Query()["tag"])
+
+	return s.ListInstances(LabelSelector(query), LabelSelector(tags))
+}
+
+// consulNodes returns nodes by ID.
+func (s *Server) consulNodes() (map[string]*api.Node, error) {
+	nodes, err := s.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]*api.Node, len(nodes))
+	for _, n := range nodes {
+		m[n.ID] = n
+	}
+	return m, nil
+}
+
+// consulBlock waits for a change if this is a Consul blocking query, then
+// sets the index header. Any change to the registry wakes it, which Consul
+// clients allow.
+func (s *Server) consulBlock(w http.ResponseWriter, r *http.Request) error {
+	if v := r.URL.Query().Get("index"); v != "" {
+		index, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		wait := WatchTimeout
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			if d < wait {
+				wait = d
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		// timeouts and errors just return the current state.
+		_, _ = s.Watch(ctx, index)
+		cancel()
+	}
+
+	index, err := s.Index()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	return nil
+}
+
+func (s *Server) consulCatalogServices(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := s.consulBlock(w, r); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	instances, err := s.ListInstances()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// service name to tags
+	services := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, i := range instances {
+		app := i.Labels["app"]
+		if app == "" {
+			continue
+		}
+		if _, ok := services[app]; !ok {
+			services[app] = []string{}
+		}
+		for _, tag := range labelsToTags(i.Labels) {
+			if !seen[app+"/"+tag] {
+				seen[app+"/"+tag] = true
+				services[app] = append(services[app], tag)
+			}
+		}
+	}
+
+	// onedari services are listed even without instances.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.NewKeysAPI(s.etcd).Get(ctx, path.Join(s.prefix, "services"), nil)
+	if err == nil && resp.Node != nil {
+		for _, n := range resp.Node.Nodes {
+			_, id := path.Split(n.Key)
+			if _, ok := services[id]; !ok {
+				services[id] = []string{}
+			}
+		}
+	}
+
+	for _, tags := range services {
+		sort.Strings(tags)
+	}
+
+	_ = JSON(w, http.StatusOK, services)
+}
+
+func (s *Server) consulCatalogService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps[0].Value
+
+	if err := s.consulBlock(w, r); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	instances, err := s.consulInstances(r, name)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	nodes, err := s.consulNodes()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	services := make([]*ConsulCatalogService, 0, len(instances))
+	for _, i := range instances {
+		n := consulNode(nodes, i)
+		services = append(services, &ConsulCatalogService{
+			ID:             n.ID,
+			Node:           n.Node,
+			Address:        n.Address,
+			Datacenter:     n.Datacenter,
+			ServiceID:      i.ID,
+			ServiceName:    name,
+			ServiceTags:    labelsToTags(i.Labels),
+			ServiceAddress: ipString(i.Address),
+			ServicePort:    int(i.Port),
+			ServiceMeta:    i.Metadata,
+		})
+	}
+
+	_ = JSON(w, http.StatusOK, services)
+}
+
+func (s *Server) consulHealthService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps[0].Value
+
+	if err := s.consulBlock(w, r); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	instances, err := s.consulInstances(r, name)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	nodes, err := s.consulNodes()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// ?passing has no value
+	_, passing := r.URL.Query()["passing"]
+
+	entries := make([]*ConsulServiceEntry, 0, len(instances))
+	for _, i := range instances {
+		if passing && !i.Up {
+			continue
+		}
+
+		status := "passing"
+		if !i.Up {
+			status = "critical"
+		}
+
+		n := consulNode(nodes, i)
+		entries = append(entries, &ConsulServiceEntry{
+			Node: n,
+			Service: &ConsulAgentService{
+				ID:      i.ID,
+				Service: name,
+				Tags:    labelsToTags(i.Labels),
+				Address: ipString(i.Address),
+				Port:    int(i.Port),
+				Meta:    i.Metadata,
+			},
+			Checks: []*ConsulCheck{
+				{
+					Node:        n.Node,
+					CheckID:     "service:" + i.ID,
+					Name:        "Service '" + name + "' check",
+					Status:      status,
+					ServiceID:   i.ID,
+					ServiceName: name,
+				},
+			},
+		})
+	}
+
+	_ = JSON(w, http.StatusOK, entries)
+}
+
+// consulRegister registers an instance on this node, as the Consul agent
+// does. Health checks are not supported, so the instance is up.
+func (s *Server) consulRegister(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	v := &ConsulService{}
+	if err := ParseBody(r, v); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if v.Name == "" || strings.Contains(v.Name, "/") {
+		httpError(w, http.StatusBadRequest, InvalidIDError)
+		return
+	}
+
+	i := api.NewInstance()
+	i.Node = s.Node.ID
+	i.ID = v.ID
+	if i.ID == "" {
+		i.ID = i.Node + "-" + v.Name
+	}
+	if strings.Contains(i.ID, "/") {
+		httpError(w, http.StatusBadRequest, InvalidIDError)
+		return
+	}
+
+	i.Labels = tagsToLabels(v.Tags)
+	i.Labels["app"] = v.Name
+	if v.Meta != nil {
+		i.Metadata = v.Meta
+	}
+	i.Up = true
+
+	if v.Port < 0 || v.Port > 65535 {
+		httpError(w, http.StatusBadRequest, InvalidInstanceError)
+		return
+	}
+	i.Port = uint16(v.Port)
+
+	i.Address = s.Node.Address
+	if v.Address != "" {
+		i.Address = net.ParseIP(v.Address)
+		if i.Address == nil {
+			httpError(w, http.StatusBadRequest, InvalidAddressError)
+			return
+		}
+	}
+
+	if err := s.etcdSet("instances/"+i.ID, i); err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) consulDeregister(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := s.etcdDelete("instances/" + ps[0].Value); err != nil {
+		code := http.StatusInternalServerError
+		if isKeyNotFound(err) {
+			code = http.StatusNotFound
+		}
+		httpError(w, code, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func consulNode(nodes map[string]*api.Node, i *api.Instance) *ConsulNode {
+	n := &ConsulNode{
+		ID:         i.Node,
+		Node:       i.Node,
+		Address:    ipString(i.Address),
+		Datacenter: ConsulDatacenter,
+	}
+	if node, ok := nodes[i.Node]; ok && node.Address != nil {
+		n.Address = node.Address.String()
+	}
+	return n
+}
+
+// tagsToLabels converts Consul tags to labels. A key=value tag is a label
+// and any other tag is a label with an empty value.
+func tagsToLabels(tags []string) map[string]string {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[tag] = ""
+		}
+	}
+	return labels
+}
+
+// labelsToTags is the reverse of tagsToLabels. The app label is the
+// service name, so it is not a tag.
+func labelsToTags(labels map[string]string) []string {
+	tags := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if k == "app" {
+			continue
+		}
+		if v == "" {
+			tags = append(tags, k)
+		} else {
+			tags = append(tags, k+"="+v)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -20,17 +20,23 @@ type InstanceSelectorFunc func(*api.Instance) bool
 
 // ListInstances fetches all instances optionally using the query as a selector.
 func (s *Server) ListInstances(selectors ...InstanceSelectorFunc) ([]*api.Instance, error) {
+	instances, _, err := s.fetchInstances(selectors...)
+	return instances, err
+}
+
+// fetchInstances is ListInstances that also returns the etcd index.
+func (s *Server) fetchInstances(selectors ...InstanceSelectorFunc) ([]*api.Instance, uint64, error) {
 	k := client.NewKeysAPI(s.etcd)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	resp, err := k.Get(ctx, path.Join(s.prefix, "instances"), &client.GetOptions{Recursive: true})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if resp.Node == nil || resp.Node.Nodes == nil {
-		return nil, EmptyNodeError
+		return nil, resp.Index, EmptyNodeError
 	}
 	instances := make([]*api.Instance, 0, len(resp.Node.Nodes))
 
@@ -41,7 +47,7 @@ NODES:
 
 		// should a single error be fatal??
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		_, i.ID = path.Split(n.Key)
@@ -54,7 +60,7 @@ NODES:
 
 		instances = append(instances, i)
 	}
-	return instances, nil
+	return instances, resp.Index, nil
 }
 
 func (s *Server) createInstanceNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -89,14 +95,8 @@ func (s *Server) createInstance(w http.ResponseWriter, r *http.Request, ps httpr
 		return
 	}
 
-	// should labels be required?
-	if len(i.Labels) == 0 {
-		httpError(w, http.StatusExpectationFailed, MissingLabelError)
-		return
-	}
-
-	if i.Address == nil && i.Node == "" {
-		httpError(w, http.StatusExpectationFailed, InvalidInstanceError)
+	if _, err := validateInstance(i); err != nil {
+		httpError(w, http.StatusExpectationFailed, err)
 		return
 	}
 
@@ -113,22 +113,25 @@ func (s *Server) createInstance(w http.ResponseWriter, r *http.Request, ps httpr
 }
 
 func (s *Server) listInstancesNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	query, err := QueryFromRequest(r)
+	query, opts, err := listQuery(r, &api.Instance{})
 	if err != nil {
 		httpError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	instances, err := s.ListInstances(NodeSelector(s.Node), LabelSelector(query))
-	if err != nil {
+	if err != nil && !isEmpty(err) {
 		httpError(w, http.StatusInternalServerError, err)
 		return
 	}
-	_ = JSON(w, http.StatusOK, instances)
+	if instances == nil {
+		instances = []*api.Instance{}
+	}
+	writeList(w, instances, opts)
 }
 
 func (s *Server) listInstances(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	query, err := QueryFromRequest(r)
+	query, opts, err := listQuery(r, &api.Instance{})
 	if err != nil {
 		httpError(w, http.StatusBadRequest, err)
 		return
@@ -136,11 +139,14 @@ func (s *Server) listInstances(w http.ResponseWriter, r *http.Request, ps httpro
 
 	instances, err := s.ListInstances(LabelSelector(query))
 
-	if err != nil {
+	if err != nil && !isEmpty(err) {
 		httpError(w, http.StatusInternalServerError, err)
 		return
 	}
-	_ = JSON(w, http.StatusOK, instances)
+	if instances == nil {
+		instances = []*api.Instance{}
+	}
+	writeList(w, instances, opts)
 }
 
 func (s *Server) getInstance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -163,3 +169,30 @@ func (s *Server) getInstance(w http.ResponseWriter, r *http.Request, ps httprout
 	// how to handle error??
 	_ = JSON(w, http.StatusOK, i)
 }
+
+func (s *Server) deleteInstance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := s.etcdDelete("instances/" + ps[0].Value); err != nil {
+		code := http.StatusInternalServerError
+
+		if isKeyNotFound(err) {
+			code = http.StatusNotFound
+		}
+		httpError(w, code, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateInstance returns the invalid field and why.
+func validateInstance(i *api.Instance) (string, error) {
+	// should labels be required?
+	if len(i.Labels) == 0 {
+		return "labels", MissingLabelError
+	}
+
+	if i.Address == nil && i.Node == "" {
+		return "ip", InvalidInstanceError
+	}
+	return "", nil
+}
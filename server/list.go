@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContinueHeader is the v0 response header with the continue token of the
+// next page. v1 has it in the list envelope.
+const ContinueHeader = "X-Onedari-Continue"
+
+var InvalidContinueError = errors.New("invalid continue token")
+
+type (
+	// listOptions are the paging, sorting, and sparse fieldset query
+	// parameters of a list request.
+	listOptions struct {
+		limit  int
+		sort   []sortKey
+		fields []string
+		after  map[string]interface{} // last item of the previous page
+	}
+
+	sortKey struct {
+		field string
+		desc  bool
+	}
+
+	// listEntry is an item and its fields as they are encoded.
+	listEntry struct {
+		value  interface{}
+		fields map[string]interface{}
+	}
+
+	// continueToken is the base64 encoded continue query parameter.
+	continueToken struct {
+		Sort string                 `json:"sort"`
+		Last map[string]interface{} `json:"last"`
+	}
+)
+
+// listQuery returns the label query and the list options of a request:
+// limit, continue, sort (such as node,-port), and fields (such as
+// id,ip,port). These names are reserved, so lists cannot be filtered by
+// labels with them.
+func listQuery(r *http.Request, item interface{}) (map[string]string, *listOptions, error) {
+	query, err := QueryFromRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, k := range []string{"limit", "continue", "sort", "fields"} {
+		delete(query, k)
+	}
+
+	opts := &listOptions{}
+	known := jsonFields(reflect.TypeOf(item))
+
+	if v := r.Form.Get("limit"); v != "" {
+		opts.limit, err = strconv.Atoi(v)
+		if err != nil || opts.limit < 1 {
+			return nil, nil, fmt.Errorf("invalid limit: %s", v)
+		}
+	}
+
+	sortSpec := r.Form.Get("sort")
+	if sortSpec != "" {
+		for _, f := range strings.Split(sortSpec, ",") {
+			k := sortKey{field: f}
+			if strings.HasPrefix(f, "-") {
+				k.field, k.desc = f[1:], true
+			}
+			if !known[k.field] {
+				return nil, nil, fmt.Errorf("unknown sort field: %s", k.field)
+			}
+			opts.sort = append(opts.sort, k)
+		}
+	}
+
+	if v := r.Form.Get("fields"); v != "" {
+		for _, f := range strings.Split(v, ",") {
+			if !known[f] {
+				return nil, nil, fmt.Errorf("unknown field: %s", f)
+			}
+			opts.fields = append(opts.fields, f)
+		}
+	}
+
+	if v := r.Form.Get("continue"); v != "" {
+		token := &continueToken{}
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || decodeJSON(data, token) != nil || token.Sort != sortSpec || token.Last == nil {
+			return nil, nil, InvalidContinueError
+		}
+		opts.after = token.Last
+	}
+
+	return query, opts, nil
+}
+
+// apply sorts, pages, and projects items, a slice. It returns what to
+// encode and the continue token of the next page, if any. Items are
+// unchanged if there are no options, as v0 always did.
+func (o *listOptions) apply(items interface{}) (interface{}, string, error) {
+	if o.limit == 0 && o.after == nil && len(o.sort) == 0 && len(o.fields) == 0 {
+		return items, "", nil
+	}
+
+	v := reflect.ValueOf(items)
+	entries := make([]*listEntry, 0, v.Len())
+	for n := 0; n < v.Len(); n++ {
+		e := &listEntry{value: v.Index(n).Interface()}
+		data, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := decodeJSON(data, &e.fields); err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return o.compare(entries[a].fields, entries[b].fields) < 0
+	})
+
+	if o.after != nil {
+		n := sort.Search(len(entries), func(n int) bool {
+			return o.compare(entries[n].fields, o.after) > 0
+		})
+		entries = entries[n:]
+	}
+
+	next := ""
+	if o.limit > 0 && len(entries) > o.limit {
+		entries = entries[:o.limit]
+
+		last := entries[len(entries)-1].fields
+		token := &continueToken{
+			Sort: o.sortSpec(),
+			Last: map[string]interface{}{"id": last["id"]},
+		}
+		for _, k := range o.sort {
+			token.Last[k.field] = last[k.field]
+		}
+
+		data, err := json.Marshal(token)
+		if err != nil {
+			return nil, "", err
+		}
+		next = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	if len(o.fields) == 0 {
+		out := reflect.MakeSlice(v.Type(), len(entries), len(entries))
+		for n, e := range entries {
+			out.Index(n).Set(reflect.ValueOf(e.value))
+		}
+		return out.Interface(), next, nil
+	}
+
+	out := make([]map[string]interface{}, len(entries))
+	for n, e := range entries {
+		out[n] = make(map[string]interface{}, len(o.fields))
+		for _, f := range o.fields {
+			out[n][f] = e.fields[f]
+		}
+	}
+	return out, next, nil
+}
+
+// writeList writes a v0 list. The continue token is in a header so the
+// body is still a bare array.
+func writeList(w http.ResponseWriter, items interface{}, opts *listOptions) {
+	out, next, err := opts.apply(items)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if next != "" {
+		w.Header().Set(ContinueHeader, next)
+	}
+	_ = JSON(w, http.StatusOK, out)
+}
+
+// compare orders by the sort keys and then by id, so pages are stable.
+func (o *listOptions) compare(a, b map[string]interface{}) int {
+	for _, k := range o.sort {
+		c := compareValues(a[k.field], b[k.field])
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareValues(a["id"], b["id"])
+}
+
+func (o *listOptions) sortSpec() string {
+	keys := make([]string, len(o.sort))
+	for n, k := range o.sort {
+		keys[n] = k.field
+		if k.desc {
+			keys[n] = "-" + k.field
+		}
+	}
+	return strings.Join(keys, ",")
+}
+
+// compareValues compares decoded JSON values. Missing values are first.
+// Addresses compare numerically, so 10.0.0.9 is before 10.0.0.10.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	switch x := a.(type) {
+	case json.Number:
+		if y, ok := b.(json.Number); ok {
+			fx, _ := x.Float64()
+			fy, _ := y.Float64()
+			switch {
+			case fx < fy:
+				return -1
+			case fx > fy:
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			ipx, ipy := net.ParseIP(x), net.ParseIP(y)
+			if ipx != nil && ipy != nil {
+				return bytes.Compare(ipx.To16(), ipy.To16())
+			}
+			return strings.Compare(x, y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// mixed types or objects. anything stable will do.
+	dx, _ := json.Marshal(a)
+	dy, _ := json.Marshal(b)
+	return bytes.Compare(dx, dy)
+}
+
+// jsonFields returns the JSON field names of a struct or pointer to one.
+func jsonFields(t reflect.Type) map[string]bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	fields := make(map[string]bool, t.NumField())
+	for n := 0; n < t.NumField(); n++ {
+		name := strings.Split(t.Field(n).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = t.Field(n).Name
+		}
+		if name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// decodeJSON decodes numbers as json.Number so they compare exactly.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
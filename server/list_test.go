@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bakins/onedari/api"
+)
+
+func TestListQuery(t *testing.T) {
+	token := func(sort string) string {
+		data, _ := json.Marshal(&continueToken{Sort: sort, Last: map[string]interface{}{"id": "a"}})
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	tests := []struct {
+		query  string
+		labels map[string]string
+		limit  int
+		sort   string
+		fields []string
+		after  bool
+		err    bool
+	}{
+		{query: "", labels: nil},
+		{query: "app=web&track=dev", labels: map[string]string{"app": "web", "track": "dev"}},
+		{
+			query:  "app=web&limit=2&sort=-port,node&fields=id,ip",
+			labels: map[string]string{"app": "web"},
+			limit:  2,
+			sort:   "-port,node",
+			fields: []string{"id", "ip"},
+		},
+		{query: "sort=ip&continue=" + token("ip"), labels: map[string]string{}, sort: "ip", after: true},
+		{query: "continue=" + token(""), labels: map[string]string{}, after: true},
+		{query: "limit=0", err: true},
+		{query: "limit=-1", err: true},
+		{query: "limit=ten", err: true},
+		{query: "sort=bogus", err: true},
+		{query: "sort=-", err: true},
+		{query: "fields=id,bogus", err: true},
+		{query: "continue=!!!", err: true},
+		{query: "continue=" + base64.RawURLEncoding.EncodeToString([]byte("[]")), err: true},
+		{query: "continue=" + base64.RawURLEncoding.EncodeToString([]byte(`{"sort":""}`)), err: true},
+		// the token must be for the same sort
+		{query: "sort=port&continue=" + token("ip"), err: true},
+		{query: "continue=" + token("ip"), err: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/v0/instances?"+tt.query, nil)
+		labels, opts, err := listQuery(r, &api.Instance{})
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.query, err)
+			continue
+		}
+
+		if len(labels) != len(tt.labels) || (len(labels) > 0 && !reflect.DeepEqual(labels, tt.labels)) {
+			t.Errorf("%s: expected labels %v, got %v", tt.query, tt.labels, labels)
+		}
+		if opts.limit != tt.limit {
+			t.Errorf("%s: expected limit %d, got %d", tt.query, tt.limit, opts.limit)
+		}
+		if got := opts.sortSpec(); got != tt.sort {
+			t.Errorf("%s: expected sort %q, got %q", tt.query, tt.sort, got)
+		}
+		if !reflect.DeepEqual(opts.fields, tt.fields) {
+			t.Errorf("%s: expected fields %v, got %v", tt.query, tt.fields, opts.fields)
+		}
+		if (opts.after != nil) != tt.after {
+			t.Errorf("%s: expected continue %v, got %v", tt.query, tt.after, opts.after)
+		}
+	}
+}
+
+func testInstances() []*api.Instance {
+	instance := func(id, node, ip string, port uint16) *api.Instance {
+		i := api.NewInstance()
+		i.ID, i.Node, i.Port = id, node, port
+		if ip != "" {
+			i.Address = net.ParseIP(ip)
+		}
+		return i
+	}
+	return []*api.Instance{
+		instance("e", "n2", "10.0.0.10", 80),
+		instance("b", "n1", "10.0.0.9", 443),
+		instance("d", "n2", "", 80),
+		instance("a", "n1", "10.0.0.2", 80),
+		instance("c", "n1", "2001:db8::1", 8080),
+	}
+}
+
+func ids(items interface{}) string {
+	var out []string
+	switch v := items.(type) {
+	case []*api.Instance:
+		for _, i := range v {
+			out = append(out, i.ID)
+		}
+	case []map[string]interface{}:
+		for _, m := range v {
+			out = append(out, m["id"].(string))
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// listOpts parses the list options of a query string.
+func listOpts(t *testing.T, query string) *listOptions {
+	r := httptest.NewRequest("GET", "/v0/instances?"+query, nil)
+	_, opts, err := listQuery(r, &api.Instance{})
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return opts
+}
+
+func TestListApply(t *testing.T) {
+	tests := []struct {
+		query string
+		ids   string
+		next  bool
+	}{
+		// unchanged without options
+		{"", "e,b,d,a,c", false},
+		{"app=web", "e,b,d,a,c", false},
+		// ties are broken by id
+		{"sort=node", "a,b,c,d,e", false},
+		{"sort=port", "a,d,e,b,c", false},
+		{"sort=-port", "c,b,a,d,e", false},
+		{"sort=node,-port", "c,b,a,d,e", false},
+		// addresses compare numerically and missing values are first
+		{"sort=ip", "d,a,b,e,c", false},
+		{"sort=-ip", "c,e,b,a,d", false},
+		{"limit=2", "a,b", true},
+		{"limit=5", "a,b,c,d,e", false},
+		{"limit=2&sort=-ip", "c,e", true},
+	}
+
+	for _, tt := range tests {
+		out, next, err := listOpts(t, tt.query).apply(testInstances())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.query, err)
+			continue
+		}
+		if got := ids(out); got != tt.ids {
+			t.Errorf("%s: expected %s, got %s", tt.query, tt.ids, got)
+		}
+		if (next != "") != tt.next {
+			t.Errorf("%s: expected next %v, got %q", tt.query, tt.next, next)
+		}
+	}
+}
+
+func TestListApplyFields(t *testing.T) {
+	out, _, err := listOpts(t, "fields=id,port&sort=id").apply(testInstances())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, ok := out.([]map[string]interface{})
+	if !ok {
+		t.Fatalf("expected maps, got %T", out)
+	}
+	if got := ids(items); got != "a,b,c,d,e" {
+		t.Errorf("unexpected order: %s", got)
+	}
+	for _, item := range items {
+		if len(item) != 2 || item["port"] == nil {
+			t.Errorf("expected only id and port: %v", item)
+		}
+	}
+}
+
+func TestListApplyPaging(t *testing.T) {
+	for _, sort := range []string{"", "node", "-port", "ip", "node,-ip"} {
+		// a limit orders by id even without a sort.
+		all, _, err := listOpts(t, "limit=100&sort="+sort).apply(testInstances())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pages []string
+		query := "limit=2&sort=" + sort
+		for n := 0; n < 10; n++ {
+			out, next, err := listOpts(t, query).apply(testInstances())
+			if err != nil {
+				t.Fatalf("%s: %s", query, err)
+			}
+			pages = append(pages, ids(out))
+			if next == "" {
+				break
+			}
+			query = "limit=2&sort=" + sort + "&continue=" + next
+		}
+
+		if got := strings.Join(pages, ","); got != ids(all) {
+			t.Errorf("sort=%s: pages %v do not match %s", sort, pages, ids(all))
+		}
+	}
+}
+
+func TestListApplyPagingRemoved(t *testing.T) {
+	_, next, err := listOpts(t, "limit=2&sort=port").apply(testInstances())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last item of the page is removed before the next is read.
+	instances := []*api.Instance{}
+	for _, i := range testInstances() {
+		if i.ID != "d" {
+			instances = append(instances, i)
+		}
+	}
+
+	out, _, err := listOpts(t, "limit=2&sort=port&continue="+next).apply(instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(out); got != "e,b" {
+		t.Errorf("expected e,b, got %s", got)
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{nil, nil, 0},
+		{nil, "a", -1},
+		{"a", nil, 1},
+		{nil, json.Number("0"), -1},
+		{json.Number("9"), json.Number("10"), -1},
+		{json.Number("10"), json.Number("9"), 1},
+		{json.Number("1.5"), json.Number("1.50"), 0},
+		{"a", "b", -1},
+		{"b", "a", 1},
+		{"a", "a", 0},
+		{"10.0.0.9", "10.0.0.10", -1},
+		{"10.0.0.10", "10.0.0.9", 1},
+		{"10.0.0.1", "10.0.0.1", 0},
+		{"2001:db8::2", "2001:db8::10", -1},
+		{"10.0.0.1", "2001:db8::1", -1},
+		{false, true, -1},
+		{true, false, 1},
+		{true, true, 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareValues(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareValues(%v, %v): expected %d, got %d", tt.a, tt.b, tt.want, got)
+		}
+	}
+
+	// mixed types are ordered, one way or the other.
+	mixed := []interface{}{"a", json.Number("1"), true, map[string]interface{}{"k": "v"}}
+	for _, a := range mixed {
+		for _, b := range mixed {
+			x, y := compareValues(a, b), compareValues(b, a)
+			if x != -y || (x == 0) != reflect.DeepEqual(a, b) {
+				t.Errorf("compareValues(%v, %v) is not stable: %d, %d", a, b, x, y)
+			}
+		}
+	}
+}
@@ -20,40 +20,71 @@ func (s *Server) getLocalNode(w http.ResponseWriter, r *http.Request, ps httprou
 	JSON(w, 200, s.Node)
 }
 
-func (s *Server) listNodes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// NodeSelectorFunc returns true if the node should be included.
+type NodeSelectorFunc func(*api.Node) bool
+
+// ListNodes fetches all nodes optionally using selectors.
+func (s *Server) ListNodes(selectors ...NodeSelectorFunc) ([]*api.Node, error) {
+	nodes, _, err := s.fetchNodes(selectors...)
+	return nodes, err
+}
+
+// fetchNodes is ListNodes that also returns the etcd index.
+func (s *Server) fetchNodes(selectors ...NodeSelectorFunc) ([]*api.Node, uint64, error) {
 	k := client.NewKeysAPI(s.etcd)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	resp, err := k.Get(ctx, path.Join(s.prefix, "nodes"), nil)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, err)
-		return
+		return nil, 0, err
 	}
 
 	if resp.Node == nil || resp.Node.Nodes == nil {
-		httpError(w, http.StatusInternalServerError, EmptyNodeError)
-		return
+		return nil, resp.Index, EmptyNodeError
 	}
 	nodes := make([]*api.Node, 0, len(resp.Node.Nodes))
 
+NODES:
 	for _, n := range resp.Node.Nodes {
 		node := &api.Node{}
 		err := json.Unmarshal([]byte(n.Value), node)
 
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, err)
-			return
+			return nil, 0, err
 		}
 
 		_, key := path.Split(n.Key)
 		node.ID = key
 
+		for _, f := range selectors {
+			if !f(node) {
+				continue NODES
+			}
+		}
+
 		nodes = append(nodes, node)
 	}
+	return nodes, resp.Index, nil
+}
 
-	JSON(w, 200, nodes)
+func (s *Server) listNodes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, opts, err := listQuery(r, &api.Node{})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	nodes, err := s.ListNodes()
+	if err != nil && !isEmpty(err) {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if nodes == nil {
+		nodes = []*api.Node{}
+	}
 
+	writeList(w, nodes, opts)
 }
 
 func (s *Server) getNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
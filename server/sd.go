@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/bakins/onedari/api"
+	"github.com/julienschmidt/httprouter"
+)
+
+// metaPrefix is the prefix of Prometheus discovery labels.
+const metaPrefix = "__meta_onedari_"
+
+// TargetGroup is a Prometheus http_sd_configs target group.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// prometheusSD returns the instances of a service, or the up instances
+// matching a label query, as Prometheus targets.
+func (s *Server) prometheusSD(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, err := QueryFromRequest(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var instances []*api.Instance
+	id := r.Form.Get("service")
+
+	if id != "" {
+		v := &api.Service{}
+		if err := s.etcdGet("services/"+id, v); err != nil {
+			code := http.StatusInternalServerError
+
+			if isKeyNotFound(err) {
+				code = http.StatusNotFound
+			}
+			httpError(w, code, err)
+			return
+		}
+
+		v.ID = id
+		if err := s.serviceInstances(v); err != nil && !isEmpty(err) {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		instances = v.Instances
+	} else {
+		// an empty registry has no targets
+		instances, err = s.ListInstances(LabelSelector(query), UpSelector)
+		if err != nil && !isEmpty(err) {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// stable output keeps prometheus from churning
+	sort.Slice(instances, func(a, b int) bool { return instances[a].ID < instances[b].ID })
+
+	groups := make([]*TargetGroup, 0, len(instances))
+	for _, i := range instances {
+		if i.Address == nil || i.Port == 0 {
+			continue
+		}
+
+		labels := map[string]string{
+			metaPrefix + "instance": i.ID,
+			metaPrefix + "node":     i.Node,
+			metaPrefix + "up":       strconv.FormatBool(i.Up),
+		}
+		if id != "" {
+			labels[metaPrefix+"service"] = id
+		}
+		for k, v := range i.Labels {
+			labels[metaPrefix+"label_"+labelName(k)] = v
+		}
+		for k, v := range i.Metadata {
+			labels[metaPrefix+"metadata_"+labelName(k)] = v
+		}
+
+		groups = append(groups, &TargetGroup{
+			Targets: []string{net.JoinHostPort(i.Address.String(), strconv.Itoa(int(i.Port)))},
+			Labels:  labels,
+		})
+	}
+
+	_ = JSON(w, http.StatusOK, groups)
+}
+
+// labelName replaces characters that are not valid in Prometheus label
+// names with underscores. It is always used after a prefix, so a leading
+// digit is fine.
+func labelName(k string) string {
+	b := []byte(k)
+	for n, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			b[n] = '_'
+		}
+	}
+	return string(b)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"reflect"
 	"runtime"
+	"time"
 
 	"github.com/bakins/onedari/api"
 	"github.com/coreos/etcd/client"
@@ -16,6 +17,8 @@ import (
 const (
 	DefaultAddress = "127.0.0.1:63412"
 	DefaultPrefix  = "/akins.org/onedari"
+	// WatchTimeout is how long a watch request waits for a change.
+	WatchTimeout = 60 * time.Second
 )
 
 var (
@@ -25,6 +28,10 @@ var (
 	InvalidIDError       = errors.New("invalid ID")
 	EmptyNodeError       = errors.New("empty node")
 	InvalidInstanceError = errors.New("invalid instance")
+	InvalidAddressError  = errors.New("invalid address")
+	InvalidPanicError    = errors.New("panic threshold must be between 0 and 1")
+	InvalidFailoverError = errors.New("failover must be http or https URLs")
+	NoLocalNodeError     = errors.New("no local node")
 )
 
 type (
@@ -33,6 +40,8 @@ type (
 		endpoints []string
 		etcd      client.Client
 		prefix    string
+		http      *http.Client
+		consul    bool
 		Node      *api.Node
 	}
 
@@ -69,12 +78,23 @@ func Prefix(p string) OptionFunc {
 	}
 }
 
+// HTTPClient sets the http client used to query failover endpoints.
+func HTTPClient(c *http.Client) OptionFunc {
+	return func(s *Server) error {
+		s.http = c
+		return nil
+	}
+}
+
 func New(node *api.Node, options ...OptionFunc) (*Server, error) {
 	s := &Server{
 		address:   DefaultAddress,
 		endpoints: DefaultEndpoints,
 		prefix:    DefaultPrefix,
 		Node:      node,
+		http: &http.Client{
+			Timeout: time.Duration(5 * time.Second),
+		},
 	}
 
 	for _, option := range options {
@@ -114,8 +134,14 @@ func (s *Server) Run() error {
 	r.GET("/v0/nodes", s.listNodes)
 	r.GET("/v0/nodes/:id", s.getNode)
 
+	r.GET("/v0/addresses/:ip", s.getAddress)
+
+	r.GET("/v0/watch", s.watch)
+	r.GET("/v0/index", s.getIndex)
+
 	r.PUT("/v0/instances/:id", s.createInstance)
 	r.GET("/v0/instances/:id", s.getInstance)
+	r.DELETE("/v0/instances/:id", s.deleteInstance)
 	r.GET("/v0/instances", s.listInstances)
 	// TODO: add patch
 
@@ -124,6 +150,14 @@ func (s *Server) Run() error {
 	r.GET("/v0/services", s.listServices)
 	// TODO: add patch
 
+	r.GET("/v0/sd/prometheus", s.prometheusSD)
+
+	s.v1Routes(r)
+
+	if s.consul {
+		s.consulRoutes(r)
+	}
+
 	return http.ListenAndServe(s.address, handlers.CompressHandler(r))
 
 }
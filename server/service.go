@@ -2,8 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/bakins/onedari/api"
@@ -19,21 +22,15 @@ func (s *Server) createService(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	// should labels be required?
-	if len(v.Labels) == 0 {
-		httpError(w, http.StatusExpectationFailed, MissingLabelError)
-		return
-	}
-
-	// should query be required?
-	if len(v.Query) == 0 {
-		httpError(w, http.StatusExpectationFailed, MissingQueryError)
+	if _, err := validateService(v); err != nil {
+		httpError(w, http.StatusExpectationFailed, err)
 		return
 	}
 
 	// TODO: make sure ID is something valid
 	v.ID = ps[0].Value
 	v.Instances = nil
+	v.Degraded = false
 
 	if err := s.etcdSet("services/"+v.ID, v); err != nil {
 		httpError(w, http.StatusInternalServerError, err)
@@ -44,26 +41,63 @@ func (s *Server) createService(w http.ResponseWriter, r *http.Request, ps httpro
 	_ = JSON(w, http.StatusCreated, s)
 }
 
+// validateService returns the invalid field and why.
+func validateService(v *api.Service) (string, error) {
+	// should labels be required?
+	if len(v.Labels) == 0 {
+		return "labels", MissingLabelError
+	}
+
+	// should query be required?
+	if len(v.Query) == 0 {
+		return "query", MissingQueryError
+	}
+
+	if v.PanicThreshold < 0 || v.PanicThreshold > 1 {
+		return "panic_threshold", InvalidPanicError
+	}
+
+	for _, f := range v.Failover {
+		u, err := url.Parse(f)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return "failover", InvalidFailoverError
+		}
+	}
+	return "", nil
+}
+
 func (s *Server) listServices(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	query, err := QueryFromRequest(r)
+	query, opts, err := listQuery(r, &api.Service{})
 	if err != nil {
 		httpError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	services, _, err := s.fetchServices(query)
+	if err != nil && !isEmpty(err) {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if services == nil {
+		services = []*api.Service{}
+	}
+	writeList(w, services, opts)
+}
+
+// fetchServices lists the services with labels matching query and the
+// etcd index. The instances are not included.
+func (s *Server) fetchServices(query map[string]string) ([]*api.Service, uint64, error) {
 	k := client.NewKeysAPI(s.etcd)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	resp, err := k.Get(ctx, path.Join(s.prefix, "services"), &client.GetOptions{Recursive: true})
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, err)
-		return
+		return nil, 0, err
 	}
 
 	if resp.Node == nil || resp.Node.Nodes == nil {
-		httpError(w, http.StatusInternalServerError, EmptyNodeError)
-		return
+		return nil, resp.Index, EmptyNodeError
 	}
 	services := make([]*api.Service, 0, len(resp.Node.Nodes))
 
@@ -75,8 +109,7 @@ NODES:
 
 		// should a single error be fatal??
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, err)
-			return
+			return nil, 0, err
 		}
 
 		_, key := path.Split(n.Key)
@@ -87,7 +120,7 @@ NODES:
 		}
 		services = append(services, v)
 	}
-	_ = JSON(w, http.StatusOK, services)
+	return services, resp.Index, nil
 }
 
 func (s *Server) getService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -107,12 +140,90 @@ func (s *Server) getService(w http.ResponseWriter, r *http.Request, ps httproute
 
 	v.ID = id
 
-	var err error
-	v.Instances, err = s.ListInstances(LabelSelector(v.Query), UpSelector)
-	if err != nil {
+	if err := s.serviceInstances(v); err != nil {
 		httpError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if !hasUp(v.Instances) && r.URL.Query().Get("failover") != "false" {
+		s.failoverInstances(v)
+	}
+
 	_ = JSON(w, http.StatusOK, v)
 }
+
+// serviceInstances sets the up instances of the service. If the fraction
+// that are up is below the panic threshold, all instances are set instead
+// so the few that are up are not overwhelmed.
+func (s *Server) serviceInstances(v *api.Service) error {
+	all, err := s.ListInstances(LabelSelector(v.Query))
+	if err != nil {
+		return err
+	}
+
+	up := make([]*api.Instance, 0, len(all))
+	for _, i := range all {
+		if UpSelector(i) {
+			up = append(up, i)
+		}
+	}
+
+	v.Instances = up
+	v.Degraded = false
+
+	if len(all) > 0 && float64(len(up))/float64(len(all)) < v.PanicThreshold {
+		v.Instances = all
+		v.Degraded = true
+	}
+	return nil
+}
+
+// hasUp returns true if any of the instances are up. A degraded service
+// may have instances when none are up.
+func hasUp(instances []*api.Instance) bool {
+	for _, i := range instances {
+		if UpSelector(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverInstances sets the instances of the service from the first
+// failover endpoint that has any up.
+func (s *Server) failoverInstances(v *api.Service) {
+	for _, endpoint := range v.Failover {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		remote := &api.Service{}
+		// failover=false keeps endpoints from failing over to each other.
+		if err := s.getRemote(endpoint+"/v0/services/"+url.PathEscape(v.ID)+"?failover=false", remote); err != nil {
+			// should we log this?
+			continue
+		}
+
+		if !hasUp(remote.Instances) {
+			continue
+		}
+
+		for _, i := range remote.Instances {
+			i.Remote = endpoint
+		}
+		v.Instances = remote.Instances
+		v.Degraded = remote.Degraded
+		return
+	}
+}
+
+func (s *Server) getRemote(uri string, v interface{}) error {
+	resp, err := s.http.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -14,19 +14,7 @@ import (
 // LabelSelector returns true if the given query matches the instance.
 func LabelSelector(query map[string]string) InstanceSelectorFunc {
 	return func(i *api.Instance) bool {
-		if query == nil || len(query) == 0 {
-			return true
-		}
-
-		// just terrible
-		labels := i.Labels
-		for k, v := range query {
-			val, ok := labels[k]
-			if !ok || v != val {
-				return false
-			}
-		}
-		return true
+		return api.LabelMatches(i.Labels, query)
 	}
 }
 
@@ -45,18 +33,7 @@ func NodeSelector(n *api.Node) InstanceSelectorFunc {
 
 // LabelMatches returns true if all the labels in query match label.
 func LabelMatches(labels, query map[string]string) bool {
-	if query == nil || len(query) == 0 {
-		return true
-	}
-
-	// just terrible
-	for k, v := range query {
-		val, ok := labels[k]
-		if !ok || v != val {
-			return false
-		}
-	}
-	return true
+	return api.LabelMatches(labels, query)
 }
 
 func QueryFromRequest(r *http.Request) (map[string]string, error) {
@@ -79,6 +56,12 @@ func isKeyNotFound(err error) bool {
 	return ok && e.Code == client.ErrorCodeKeyNotFound
 }
 
+// isEmpty returns true if a list failed only because there is nothing in
+// it yet.
+func isEmpty(err error) bool {
+	return err == EmptyNodeError || isKeyNotFound(err)
+}
+
 func (s *Server) etcdSet(key string, v interface{}) error {
 	k := client.NewKeysAPI(s.etcd)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -92,17 +75,51 @@ func (s *Server) etcdSet(key string, v interface{}) error {
 	return err
 }
 
+func (s *Server) etcdDelete(key string) error {
+	k := client.NewKeysAPI(s.etcd)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := k.Delete(ctx, path.Join(s.prefix, key), nil)
+	return err
+}
+
 func (s *Server) etcdGet(key string, v interface{}) error {
+	_, err := s.etcdGetIndex(key, v)
+	return err
+}
+
+// etcdGetIndex is etcdGet that also returns the modified index of the key.
+func (s *Server) etcdGetIndex(key string, v interface{}) (uint64, error) {
 	k := client.NewKeysAPI(s.etcd)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	resp, err := k.Get(ctx, path.Join(s.prefix, key), nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	return resp.Node.ModifiedIndex, json.Unmarshal([]byte(resp.Node.Value), v)
+}
+
+// etcdPut is etcdSet with options. It returns whether the key was created
+// and its new modified index.
+func (s *Server) etcdPut(key string, v interface{}, opts *client.SetOptions) (bool, uint64, error) {
+	k := client.NewKeysAPI(s.etcd)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, 0, err
 	}
 
-	return json.Unmarshal([]byte(resp.Node.Value), v)
+	resp, err := k.Set(ctx, path.Join(s.prefix, key), string(data), opts)
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.PrevNode == nil, resp.Node.ModifiedIndex, nil
 }
 
 func httpError(w http.ResponseWriter, code int, err error) {
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bakins/onedari/api"
+	"github.com/coreos/etcd/client"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+)
+
+// Error codes of the v1 API.
+const (
+	BadRequestCode = "bad_request"
+	NotFoundCode   = "not_found"
+	ConflictCode   = "conflict"
+	InvalidCode    = "invalid"
+	InternalCode   = "internal"
+	GoneCode       = "gone"
+)
+
+// v1Routes adds the v1 API. Unlike v0, errors have a typed body with
+// 400, 404, 409, 422 codes and lists have an envelope.
+func (s *Server) v1Routes(r *httprouter.Router) {
+	r.GET("/v1/node", s.v1GetLocalNode)
+
+	r.GET("/v1/nodes", s.v1ListNodes)
+	r.GET("/v1/nodes/:id", s.v1GetNode)
+
+	r.GET("/v1/index", s.v1Index)
+	r.GET("/v1/watch", s.v1Watch)
+
+	r.PUT("/v1/instances/:id", s.v1PutInstance)
+	r.GET("/v1/instances/:id", s.v1GetInstance)
+	r.DELETE("/v1/instances/:id", s.v1Delete("instances"))
+	r.GET("/v1/instances", s.v1ListInstances)
+
+	r.PUT("/v1/services/:id", s.v1PutService)
+	r.GET("/v1/services/:id", s.v1GetService)
+	r.DELETE("/v1/services/:id", s.v1Delete("services"))
+	r.GET("/v1/services", s.v1ListServices)
+}
+
+// v1Error writes a typed error. field is the invalid field, if any.
+func v1Error(w http.ResponseWriter, status int, code, field string, err error) {
+	_ = JSON(w, status, &api.Error{
+		Status:  status,
+		Code:    code,
+		Message: err.Error(),
+		Field:   field,
+	})
+}
+
+// v1EtcdError writes an error from etcd.
+func v1EtcdError(w http.ResponseWriter, err error) {
+	e, ok := err.(client.Error)
+	switch {
+	case ok && e.Code == client.ErrorCodeKeyNotFound:
+		v1Error(w, http.StatusNotFound, NotFoundCode, "", err)
+	case ok && (e.Code == client.ErrorCodeTestFailed || e.Code == client.ErrorCodeNodeExist):
+		v1Error(w, http.StatusConflict, ConflictCode, "", err)
+	default:
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+	}
+}
+
+// v1List writes a list envelope.
+func v1List(w http.ResponseWriter, items interface{}, index uint64, opts *listOptions) {
+	out, next, err := opts.apply(items)
+	if err != nil {
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		return
+	}
+
+	_ = JSON(w, http.StatusOK, &api.List{Items: out, Index: index, Continue: next})
+}
+
+// setOptions returns the etcd options for a conditional put.
+// "If-None-Match: *" only creates, "If-Match: *" only replaces, and
+// "If-Match" with the ETag of a get only replaces that version. Each fails
+// with 409 Conflict.
+func setOptions(r *http.Request) (*client.SetOptions, error) {
+	opts := &client.SetOptions{}
+
+	if r.Header.Get("If-None-Match") == "*" {
+		opts.PrevExist = client.PrevNoExist
+	}
+
+	switch v := r.Header.Get("If-Match"); v {
+	case "":
+	case "*":
+		opts.PrevExist = client.PrevExist
+	default:
+		index, err := strconv.ParseUint(strings.Trim(v, `"`), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		opts.PrevIndex = index
+	}
+
+	return opts, nil
+}
+
+func setETag(w http.ResponseWriter, index uint64) {
+	w.Header().Set("ETag", `"`+strconv.FormatUint(index, 10)+`"`)
+}
+
+// v1Parse decodes the body. It writes an error and returns false if it
+// fails.
+func v1Parse(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		v1Error(w, http.StatusBadRequest, BadRequestCode, "", err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) v1ListNodes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, opts, err := listQuery(r, &api.Node{})
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, BadRequestCode, "", err)
+		return
+	}
+
+	nodes, index, err := s.fetchNodes()
+	if err != nil && !isEmpty(err) {
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		return
+	}
+	if nodes == nil {
+		nodes = []*api.Node{}
+	}
+
+	v1List(w, nodes, index, opts)
+}
+
+func (s *Server) v1GetLocalNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Node == nil {
+		v1Error(w, http.StatusNotFound, NotFoundCode, "", NoLocalNodeError)
+		return
+	}
+	s.v1GetNode(w, r, httprouter.Params{{Key: "id", Value: s.Node.ID}})
+}
+
+func (s *Server) v1GetNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps[0].Value
+
+	n := &api.Node{}
+	index, err := s.etcdGetIndex("nodes/"+id, n)
+	if err != nil {
+		v1EtcdError(w, err)
+		return
+	}
+
+	n.ID = id
+	setETag(w, index)
+	_ = JSON(w, http.StatusOK, n)
+}
+
+func (s *Server) v1ListInstances(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, opts, err := listQuery(r, &api.Instance{})
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, BadRequestCode, "", err)
+		return
+	}
+
+	instances, index, err := s.fetchInstances(LabelSelector(query))
+	if err != nil && !isEmpty(err) {
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		return
+	}
+	if instances == nil {
+		instances = []*api.Instance{}
+	}
+
+	v1List(w, instances, index, opts)
+}
+
+func (s *Server) v1GetInstance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps[0].Value
+
+	i := &api.Instance{}
+	index, err := s.etcdGetIndex("instances/"+id, i)
+	if err != nil {
+		v1EtcdError(w, err)
+		return
+	}
+
+	i.ID = id
+	setETag(w, index)
+	_ = JSON(w, http.StatusOK, i)
+}
+
+func (s *Server) v1PutInstance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	i := &api.Instance{}
+	if !v1Parse(w, r, i) {
+		return
+	}
+
+	id := ps[0].Value
+	if i.ID != "" && i.ID != id {
+		v1Error(w, http.StatusUnprocessableEntity, InvalidCode, "id", InvalidIDError)
+		return
+	}
+	i.ID = id
+
+	if field, err := validateInstance(i); err != nil {
+		v1Error(w, http.StatusUnprocessableEntity, InvalidCode, field, err)
+		return
+	}
+
+	s.v1Put(w, r, "instances/"+id, i)
+}
+
+func (s *Server) v1ListServices(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, opts, err := listQuery(r, &api.Service{})
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, BadRequestCode, "", err)
+		return
+	}
+
+	services, index, err := s.fetchServices(query)
+	if err != nil && !isEmpty(err) {
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		return
+	}
+	if services == nil {
+		services = []*api.Service{}
+	}
+
+	v1List(w, services, index, opts)
+}
+
+func (s *Server) v1GetService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps[0].Value
+
+	v := &api.Service{}
+	index, err := s.etcdGetIndex("services/"+id, v)
+	if err != nil {
+		v1EtcdError(w, err)
+		return
+	}
+
+	v.ID = id
+
+	if err := s.serviceInstances(v); err != nil && !isEmpty(err) {
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		return
+	}
+
+	if !hasUp(v.Instances) && r.URL.Query().Get("failover") != "false" {
+		s.failoverInstances(v)
+	}
+
+	setETag(w, index)
+	_ = JSON(w, http.StatusOK, v)
+}
+
+func (s *Server) v1PutService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	v := &api.Service{}
+	if !v1Parse(w, r, v) {
+		return
+	}
+
+	id := ps[0].Value
+	if v.ID != "" && v.ID != id {
+		v1Error(w, http.StatusUnprocessableEntity, InvalidCode, "id", InvalidIDError)
+		return
+	}
+	v.ID = id
+
+	if field, err := validateService(v); err != nil {
+		v1Error(w, http.StatusUnprocessableEntity, InvalidCode, field, err)
+		return
+	}
+
+	v.Instances = nil
+	v.Degraded = false
+
+	s.v1Put(w, r, "services/"+id, v)
+}
+
+// v1Put saves v and writes it back. It is 201 Created if it is new.
+func (s *Server) v1Put(w http.ResponseWriter, r *http.Request, key string, v interface{}) {
+	opts, err := setOptions(r)
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, BadRequestCode, "", err)
+		return
+	}
+
+	created, index, err := s.etcdPut(key, v, opts)
+	if err != nil {
+		// only a conditional put needs the key to exist.
+		if isKeyNotFound(err) {
+			v1Error(w, http.StatusConflict, ConflictCode, "", err)
+			return
+		}
+		v1EtcdError(w, err)
+		return
+	}
+
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+
+	setETag(w, index)
+	_ = JSON(w, code, v)
+}
+
+func (s *Server) v1Delete(kind string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if err := s.etcdDelete(kind + "/" + ps[0].Value); err != nil {
+			v1EtcdError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) v1Index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	index, err := s.Index()
+	if err != nil {
+		v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		return
+	}
+
+	_ = JSON(w, http.StatusOK, &api.Index{Index: index})
+}
+
+// v1Watch is watch with typed errors.
+func (s *Server) v1Watch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var index uint64
+	if v := r.URL.Query().Get("index"); v != "" {
+		var err error
+		index, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			v1Error(w, http.StatusBadRequest, BadRequestCode, "index", err)
+			return
+		}
+	}
+
+	// stop waiting when the client goes away.
+	ctx, cancel := context.WithTimeout(r.Context(), WatchTimeout)
+	defer cancel()
+
+	e, err := s.Watch(ctx, index)
+	if err != nil {
+		switch {
+		case err == context.DeadlineExceeded:
+			w.WriteHeader(http.StatusNoContent)
+		case isIndexCleared(err):
+			// the caller is too far behind and must start over.
+			v1Error(w, http.StatusGone, GoneCode, "index", err)
+		default:
+			v1Error(w, http.StatusInternalServerError, InternalCode, "", err)
+		}
+		return
+	}
+
+	_ = JSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakins/onedari/api"
+	"github.com/coreos/etcd/client"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+)
+
+func isIndexCleared(err error) bool {
+	e, ok := err.(client.Error)
+	return ok && e.Code == client.ErrorCodeEventIndexCleared
+}
+
+// Index returns the current index of the registry.
+func (s *Server) Index() (uint64, error) {
+	k := client.NewKeysAPI(s.etcd)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := k.Get(ctx, s.prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
+func (s *Server) getIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	index, err := s.Index()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_ = JSON(w, http.StatusOK, &api.Index{Index: index})
+}
+
+// Watch blocks until there is a change after index or the context is done.
+func (s *Server) Watch(ctx context.Context, index uint64) (*api.Event, error) {
+	k := client.NewKeysAPI(s.etcd)
+
+	w := k.Watcher(s.prefix, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+	resp, err := w.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &api.Event{
+		Action: resp.Action,
+	}
+	if resp.Node != nil {
+		e.Index = resp.Node.ModifiedIndex
+		key := strings.TrimPrefix(strings.TrimPrefix(resp.Node.Key, s.prefix), "/")
+		parts := strings.SplitN(key, "/", 2)
+		e.Type = parts[0]
+		if len(parts) == 2 {
+			e.ID = parts[1]
+		}
+	}
+	return e, nil
+}
+
+// watch is a long poll. It returns the next change after the index query
+// parameter, or No Content if there were no changes before WatchTimeout.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var index uint64
+	if v := r.URL.Query().Get("index"); v != "" {
+		var err error
+		index, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	// stop waiting when the client goes away.
+	ctx, cancel := context.WithTimeout(r.Context(), WatchTimeout)
+	defer cancel()
+
+	e, err := s.Watch(ctx, index)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		code := http.StatusInternalServerError
+		// the caller is too far behind and must start over.
+		if isIndexCleared(err) {
+			code = http.StatusGone
+		}
+		httpError(w, code, err)
+		return
+	}
+
+	_ = JSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,422 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+)
+
+const (
+	// DefaultSuffix is the default host suffix for service names, as in
+	// http://foo.service/
+	DefaultSuffix = ".service"
+	// DefaultRefresh is the default age at which a service's instances
+	// are fetched again.
+	DefaultRefresh = 10 * time.Second
+	// DefaultEjection is the default time an instance is skipped after a
+	// connection failure.
+	DefaultEjection = 30 * time.Second
+)
+
+// Strategies for choosing an instance.
+const (
+	RoundRobin = iota
+	Weighted
+	LeastOutstanding
+)
+
+type (
+	// Transport is an http.RoundTripper that sends requests for
+	// http://<service><suffix>/ to a healthy instance of the service.
+	// Other requests are sent unchanged.
+	Transport struct {
+		sync.Mutex
+		client   *client.Client
+		next     http.RoundTripper
+		strategy int
+		suffix   string
+		refresh  time.Duration
+		ejection time.Duration
+		retries  int
+		outlier  int64
+		services map[string]*service
+	}
+
+	OptionFunc func(*Transport) error
+
+	service struct {
+		sync.Mutex
+		instances []*instance
+		fetched   time.Time
+		next      uint64 // for round robin
+	}
+
+	// the counters are updated atomically, so are first to be 64-bit
+	// aligned on 32-bit platforms.
+	instance struct {
+		outstanding int64
+		ejected     int64 // unix nanoseconds the instance is ejected until
+		failures    int64 // consecutive 5xx responses
+		addr        string
+		weight      int
+	}
+)
+
+// Client sets the API client.
+func Client(c *client.Client) OptionFunc {
+	return func(t *Transport) error {
+		t.client = c
+		return nil
+	}
+}
+
+// Next sets the RoundTripper requests are sent with. Default is
+// http.DefaultTransport.
+func Next(next http.RoundTripper) OptionFunc {
+	return func(t *Transport) error {
+		t.next = next
+		return nil
+	}
+}
+
+// Strategy sets how instances are chosen: RoundRobin, Weighted by the
+// weight metadata, or LeastOutstanding requests.
+func Strategy(strategy int) OptionFunc {
+	return func(t *Transport) error {
+		switch strategy {
+		case RoundRobin, Weighted, LeastOutstanding:
+		default:
+			return fmt.Errorf("unknown strategy: %d", strategy)
+		}
+		t.strategy = strategy
+		return nil
+	}
+}
+
+// Suffix sets the host suffix for service names.
+func Suffix(suffix string) OptionFunc {
+	return func(t *Transport) error {
+		t.suffix = suffix
+		return nil
+	}
+}
+
+// Refresh sets how often a service's instances are fetched.
+func Refresh(refresh time.Duration) OptionFunc {
+	return func(t *Transport) error {
+		t.refresh = refresh
+		return nil
+	}
+}
+
+// Ejection sets how long an instance is skipped after a connection failure.
+func Ejection(ejection time.Duration) OptionFunc {
+	return func(t *Transport) error {
+		t.ejection = ejection
+		return nil
+	}
+}
+
+// Retries sets how many other instances are tried when connecting to an
+// instance fails. Only requests without a body, or with GetBody set, are
+// retried. Default is 0.
+func Retries(retries int) OptionFunc {
+	return func(t *Transport) error {
+		if retries < 0 {
+			return fmt.Errorf("invalid retries: %d", retries)
+		}
+		t.retries = retries
+		return nil
+	}
+}
+
+// Outlier ejects an instance after this many consecutive 5xx responses.
+// Default is 0, which disables it.
+func Outlier(failures int) OptionFunc {
+	return func(t *Transport) error {
+		if failures < 0 {
+			return fmt.Errorf("invalid outlier failures: %d", failures)
+		}
+		t.outlier = int64(failures)
+		return nil
+	}
+}
+
+// New creates a new Transport.
+func New(options ...OptionFunc) (*Transport, error) {
+	t := &Transport{
+		next:     http.DefaultTransport,
+		strategy: RoundRobin,
+		suffix:   DefaultSuffix,
+		refresh:  DefaultRefresh,
+		ejection: DefaultEjection,
+		services: make(map[string]*service),
+	}
+
+	for _, option := range options {
+		if err := option(t); err != nil {
+			f := runtime.FuncForPC(reflect.ValueOf(option).Pointer()).Name()
+			return nil, fmt.Errorf("failure in function %s: %s", f, err)
+		}
+	}
+
+	if t.client == nil {
+		var err error
+		t.client, err = client.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	if !strings.HasSuffix(host, t.suffix) {
+		return t.next.RoundTrip(req)
+	}
+	name := strings.TrimSuffix(host, t.suffix)
+
+	v, err := t.service(req, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		i := t.choose(v)
+		if i == nil {
+			return nil, fmt.Errorf("no instances of service: %s", name)
+		}
+
+		// a RoundTripper must not modify the request
+		r := req.Clone(req.Context())
+		r.URL.Host = i.addr
+		if r.Host == "" {
+			r.Host = req.URL.Host
+		}
+		if attempt > 0 && req.GetBody != nil {
+			r.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		atomic.AddInt64(&i.outstanding, 1)
+		resp, err := t.next.RoundTrip(r)
+
+		if err != nil {
+			atomic.AddInt64(&i.outstanding, -1)
+
+			// cancelled requests and timeouts say nothing about the
+			// instance.
+			if !isConnectError(err) {
+				return nil, err
+			}
+
+			// passive health check. skip it for a while.
+			t.eject(i)
+
+			// the ejected instance will not be chosen again
+			if attempt < t.retries && canRetry(req) {
+				continue
+			}
+			return nil, err
+		}
+
+		// the request is outstanding until the body is read.
+		resp.Body = trackBody(resp.Body, func() {
+			atomic.AddInt64(&i.outstanding, -1)
+		})
+
+		if resp.StatusCode >= 500 {
+			if t.outlier > 0 && atomic.AddInt64(&i.failures, 1) >= t.outlier {
+				t.eject(i)
+			}
+		} else {
+			atomic.StoreInt64(&i.failures, 0)
+		}
+
+		return resp, nil
+	}
+}
+
+func (t *Transport) eject(i *instance) {
+	atomic.StoreInt64(&i.ejected, time.Now().Add(t.ejection).UnixNano())
+	atomic.StoreInt64(&i.failures, 0)
+}
+
+// isConnectError returns true if the request was never sent.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+type (
+	// body calls done once when it is closed.
+	body struct {
+		io.ReadCloser
+		once sync.Once
+		done func()
+	}
+
+	// readWriteBody is a body that is also writable, as for protocol
+	// upgrades.
+	readWriteBody struct {
+		*body
+		io.Writer
+	}
+)
+
+// trackBody returns rc wrapped to call done when it is closed. Writable
+// bodies stay writable.
+func trackBody(rc io.ReadCloser, done func()) io.ReadCloser {
+	b := &body{ReadCloser: rc, done: done}
+	if w, ok := rc.(io.ReadWriteCloser); ok {
+		return &readWriteBody{body: b, Writer: w}
+	}
+	return b
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// canRetry returns true if the request body can be sent again.
+func canRetry(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// service returns the instances of a service, fetching them if they are
+// older than the refresh interval.
+func (t *Transport) service(req *http.Request, name string) (*service, error) {
+	t.Lock()
+	v, ok := t.services[name]
+	if !ok {
+		v = &service{}
+		t.services[name] = v
+	}
+	t.Unlock()
+
+	v.Lock()
+	defer v.Unlock()
+
+	if time.Since(v.fetched) < t.refresh && len(v.instances) > 0 {
+		return v, nil
+	}
+
+	s, err := t.client.Service(req.Context(), name)
+	if err != nil {
+		// use what we have, if anything.
+		if len(v.instances) > 0 {
+			return v, nil
+		}
+		return nil, err
+	}
+
+	// keep the state of instances we already know.
+	known := make(map[string]*instance, len(v.instances))
+	for _, i := range v.instances {
+		known[i.addr] = i
+	}
+
+	instances := make([]*instance, 0, len(s.Instances))
+	for _, si := range s.Instances {
+		if si.Address == nil {
+			continue
+		}
+		addr := instanceAddr(si)
+		i, ok := known[addr]
+		if !ok {
+			i = &instance{addr: addr}
+		}
+		i.weight = int(si.MetadataInt("weight"))
+		instances = append(instances, i)
+	}
+
+	v.instances = instances
+	v.fetched = time.Now()
+	return v, nil
+}
+
+// choose picks an instance using the strategy. Ejected instances are
+// skipped unless all are ejected.
+func (t *Transport) choose(v *service) *instance {
+	v.Lock()
+	defer v.Unlock()
+
+	now := time.Now().UnixNano()
+	healthy := make([]*instance, 0, len(v.instances))
+	for _, i := range v.instances {
+		if atomic.LoadInt64(&i.ejected) < now {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = v.instances
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	v.next++
+
+	switch t.strategy {
+	case Weighted:
+		total := 0
+		for _, i := range healthy {
+			total += i.weight
+		}
+		if total == 0 {
+			break
+		}
+		n := rand.Intn(total)
+		for _, i := range healthy {
+			if n < i.weight {
+				return i
+			}
+			n -= i.weight
+		}
+
+	case LeastOutstanding:
+		// start at the round robin position so ties are spread out.
+		var best *instance
+		for j := range healthy {
+			i := healthy[(int(v.next)+j)%len(healthy)]
+			if best == nil || atomic.LoadInt64(&i.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	return healthy[int(v.next%uint64(len(healthy)))]
+}
+
+// instanceAddr returns host:port for the instance, or just the host if it
+// has no port.
+func instanceAddr(i *api.Instance) string {
+	if i.Port == 0 {
+		if i.Address.To4() == nil {
+			return "[" + i.Address.String() + "]"
+		}
+		return i.Address.String()
+	}
+	return net.JoinHostPort(i.Address.String(), strconv.Itoa(int(i.Port)))
+}
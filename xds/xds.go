@@ -0,0 +1,318 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bakins/onedari/api"
+	"github.com/bakins/onedari/client"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// DefaultAddress is the default listen address for the xDS server.
+	DefaultAddress = "127.0.0.1:18000"
+	// DefaultConnectTimeout is the default cluster connect timeout.
+	DefaultConnectTimeout = 5 * time.Second
+
+	// all Envoys get the same snapshot.
+	snapshotNode = "onedari"
+)
+
+type (
+	// Server is an Envoy xDS control plane. It serves a Cluster and a
+	// ClusterLoadAssignment for every service over ADS, CDS, and EDS.
+	Server struct {
+		// updated atomically, so first to be 64-bit aligned on 32-bit
+		// platforms.
+		version        uint64
+		address        string
+		client         *client.Client
+		connectTimeout time.Duration
+		cache          cache.SnapshotCache
+	}
+
+	OptionFunc func(*Server) error
+
+	// constantHash maps every Envoy to the same snapshot.
+	constantHash struct{}
+
+	// localityKey groups endpoints by locality and priority.
+	localityKey struct {
+		region   string
+		zone     string
+		subZone  string
+		priority uint32
+	}
+)
+
+func (constantHash) ID(*core.Node) string {
+	return snapshotNode
+}
+
+// Address sets the listen address.
+func Address(addr string) OptionFunc {
+	return func(s *Server) error {
+		s.address = addr
+		return nil
+	}
+}
+
+// Client sets the API client.
+func Client(c *client.Client) OptionFunc {
+	return func(s *Server) error {
+		s.client = c
+		return nil
+	}
+}
+
+// ConnectTimeout sets the connect timeout of clusters.
+func ConnectTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) error {
+		s.connectTimeout = timeout
+		return nil
+	}
+}
+
+// New creates a new xDS Server.
+func New(options ...OptionFunc) (*Server, error) {
+	s := &Server{
+		address:        DefaultAddress,
+		connectTimeout: DefaultConnectTimeout,
+		cache:          cache.NewSnapshotCache(true, constantHash{}, nil),
+	}
+
+	for _, option := range options {
+		if err := option(s); err != nil {
+			f := runtime.FuncForPC(reflect.ValueOf(option).Pointer()).Name()
+			return nil, fmt.Errorf("failure in function %s: %s", f, err)
+		}
+	}
+
+	if s.client == nil {
+		var err error
+		s.client, err = client.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Run starts the server.  It does not return, generally.
+func (s *Server) Run() error {
+	go s.watch()
+
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	server := xds.NewServer(ctx, s.cache, nil)
+
+	g := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(g, server)
+	clusterservice.RegisterClusterDiscoveryServiceServer(g, server)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(g, server)
+
+	return g.Serve(l)
+}
+
+// watch updates the snapshot whenever the registry changes. It does not
+// return.
+func (s *Server) watch() {
+	for {
+		if err := s.Update(); err != nil {
+			log.Error(err)
+		}
+
+		err := s.client.Watch(context.Background(), func(*api.Event) error {
+			if err := s.Update(); err != nil {
+				log.Error(err)
+			}
+			return nil
+		})
+		log.Error(err)
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Update builds a snapshot from the registry and pushes it to Envoys. An
+// empty registry pushes an empty snapshot, so Envoys drop every cluster.
+func (s *Server) Update() error {
+	ctx := context.Background()
+
+	summaries, err := s.client.Services(ctx, nil)
+	if err != nil && !client.IsNotFound(err) {
+		return err
+	}
+
+	clusters := make([]types.Resource, 0, len(summaries))
+	assignments := make([]types.Resource, 0, len(summaries))
+
+	for _, summary := range summaries {
+		v, err := s.client.Service(ctx, summary.ID)
+		if err != nil {
+			// deleted since it was listed
+			if client.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		clusters = append(clusters, s.cluster(v))
+		assignments = append(assignments, loadAssignment(v))
+	}
+
+	version := strconv.FormatUint(atomic.AddUint64(&s.version, 1), 10)
+
+	snapshot, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.ClusterType:  clusters,
+		resource.EndpointType: assignments,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := snapshot.Consistent(); err != nil {
+		return err
+	}
+
+	return s.cache.SetSnapshot(ctx, snapshotNode, snapshot)
+}
+
+// cluster returns an EDS cluster for the service.
+func (s *Server) cluster(v *api.Service) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:                 v.ID,
+		ConnectTimeout:       durationpb.New(s.connectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		LbPolicy:             cluster.Cluster_ROUND_ROBIN,
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ResourceApiVersion: core.ApiVersion_V3,
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{
+					Ads: &core.AggregatedConfigSource{},
+				},
+			},
+		},
+	}
+}
+
+// loadAssignment returns the endpoints of the service. Locality comes from
+// the region, zone, and sub_zone labels and weight and priority from the
+// metadata. Lower priority is preferred, as with SRV records.
+func loadAssignment(v *api.Service) *endpoint.ClusterLoadAssignment {
+	groups := make(map[localityKey][]*endpoint.LbEndpoint)
+
+	for _, i := range v.Instances {
+		if i.Address == nil || i.Port == 0 {
+			continue
+		}
+
+		key := localityKey{
+			region:   i.Labels["region"],
+			zone:     i.Labels["zone"],
+			subZone:  i.Labels["sub_zone"],
+			priority: uint32(i.MetadataInt("priority")),
+		}
+
+		health := core.HealthStatus_HEALTHY
+		if !i.Up {
+			// included when the service is degraded.
+			health = core.HealthStatus_UNHEALTHY
+		}
+
+		weight := uint32(i.MetadataInt("weight"))
+		// envoy requires a weight of at least 1
+		if weight == 0 {
+			weight = 1
+		}
+
+		groups[key] = append(groups[key], &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Address: i.Address.String(),
+								PortSpecifier: &core.SocketAddress_PortValue{
+									PortValue: uint32(i.Port),
+								},
+							},
+						},
+					},
+				},
+			},
+			HealthStatus:        health,
+			LoadBalancingWeight: wrapperspb.UInt32(weight),
+		})
+	}
+
+	// envoy priorities must start at 0 and be contiguous.
+	priorities := []uint32{}
+	seen := make(map[uint32]bool)
+	for key := range groups {
+		if !seen[key.priority] {
+			seen[key.priority] = true
+			priorities = append(priorities, key.priority)
+		}
+	}
+	sort.Slice(priorities, func(a, b int) bool { return priorities[a] < priorities[b] })
+
+	envoyPriority := make(map[uint32]uint32, len(priorities))
+	for n, p := range priorities {
+		envoyPriority[p] = uint32(n)
+	}
+
+	keys := make([]localityKey, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	// stable order so unchanged services produce the same resource
+	sort.Slice(keys, func(a, b int) bool {
+		return fmt.Sprint(keys[a]) < fmt.Sprint(keys[b])
+	})
+
+	cla := &endpoint.ClusterLoadAssignment{
+		ClusterName: v.ID,
+		Endpoints:   make([]*endpoint.LocalityLbEndpoints, 0, len(keys)),
+	}
+
+	for _, key := range keys {
+		cla.Endpoints = append(cla.Endpoints, &endpoint.LocalityLbEndpoints{
+			Locality: &core.Locality{
+				Region:  key.region,
+				Zone:    key.zone,
+				SubZone: key.subZone,
+			},
+			Priority:    envoyPriority[key.priority],
+			LbEndpoints: groups[key],
+		})
+	}
+
+	return cla
+}
@@ -0,0 +1,76 @@
+package xds
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bakins/onedari/client"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func testServer(t *testing.T, handler http.HandlerFunc) *Server {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	c, err := client.New(client.Endpoints([]string{ts.URL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(Client(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// clusters returns the names of the clusters in the current snapshot.
+func clusters(t *testing.T, s *Server) map[string]bool {
+	snapshot, err := s.cache.GetSnapshot(snapshotNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for name := range snapshot.GetResources(resource.ClusterType) {
+		names[name] = true
+	}
+	return names
+}
+
+func TestUpdateEmpty(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNotFound} {
+		s := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`[]`))
+		})
+
+		if err := s.Update(); err != nil {
+			t.Fatalf("%d: %s", status, err)
+		}
+		if got := clusters(t, s); len(got) != 0 {
+			t.Errorf("%d: expected no clusters, got %v", status, got)
+		}
+	}
+}
+
+func TestUpdateSkipsDeletedServices(t *testing.T) {
+	s := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/services":
+			_, _ = w.Write([]byte(`[{"id":"gone"},{"id":"web"}]`))
+		case "/v0/services/web":
+			_, _ = w.Write([]byte(`{"id":"web","instances":[{"id":"web1","ip":"10.0.0.1","port":80,"up":true}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	if err := s.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if got := clusters(t, s); len(got) != 1 || !got["web"] {
+		t.Errorf("expected only web, got %v", got)
+	}
+}